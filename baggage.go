@@ -0,0 +1,119 @@
+package ottwirp
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+
+	ot "github.com/opentracing/opentracing-go"
+)
+
+// DefaultBaggageHeaderPrefix is the baggage header prefix WithBaggageLimits
+// uses when BaggageLimits.HeaderPrefix is empty, as used by basictracer and
+// LightStep.
+const DefaultBaggageHeaderPrefix = "ot-baggage-"
+
+// BaggageItem represents a single baggage item.
+type BaggageItem struct {
+	Key   string
+	Value string
+}
+
+// BaggageLimits bounds the baggage accepted from incoming requests.
+//
+// A span context cannot drop baggage items once it has been extracted, so the
+// limits are enforced on the request headers before extraction. HeaderPrefix
+// is the prefix of the headers the tracer carries baggage items in, such as
+// "uberctx-" for Jaeger or "ot-baggage-" for basictracer. It defaults to
+// DefaultBaggageHeaderPrefix.
+type BaggageLimits struct {
+	HeaderPrefix string
+
+	// MaxItems is the maximum number of baggage items, and MaxBytes the maximum
+	// total size of their keys and values. Every value of a header repeated in
+	// the request counts as an item. Zero means no limit.
+	MaxItems int
+	MaxBytes int
+}
+
+// WithBaggageTags defines baggage keys whose values are set as tags of the same
+// name on server and client spans.
+func WithBaggageTags(keys ...string) TraceOption {
+	return func(opts *TraceOptions) {
+		opts.baggageTags = append(opts.baggageTags, keys...)
+	}
+}
+
+// WithContextBaggage defines a function that returns baggage items to set on
+// client spans before their context is injected into the outgoing request.
+// This is useful to propagate values from the request ctx, such as a tenant
+// ID, to every downstream service.
+func WithContextBaggage(fn func(ctx context.Context) []BaggageItem) TraceOption {
+	return func(opts *TraceOptions) {
+		opts.ctxBaggageFn = fn
+	}
+}
+
+// WithBaggageLimits limits the baggage server spans accept from incoming
+// requests. Baggage items are kept in key order until a limit is reached, and
+// the span is tagged with baggage.truncated if any item is dropped.
+func WithBaggageLimits(limits BaggageLimits) TraceOption {
+	if limits.HeaderPrefix == "" {
+		// Every header has the empty prefix, so the limits would apply to
+		// headers such as Content-Type and drop the span context itself.
+		limits.HeaderPrefix = DefaultBaggageHeaderPrefix
+	}
+	return func(opts *TraceOptions) {
+		opts.baggageLimits = &limits
+	}
+}
+
+// setContextBaggage sets the baggage items returned by the WithContextBaggage
+// function on the span.
+func (opts *TraceOptions) setContextBaggage(ctx context.Context, span ot.Span) {
+	if opts.ctxBaggageFn == nil {
+		return
+	}
+	for _, item := range opts.ctxBaggageFn(ctx) {
+		span.SetBaggageItem(item.Key, item.Value)
+	}
+}
+
+// setBaggageTags tags the span with the values of the WithBaggageTags keys.
+func (opts *TraceOptions) setBaggageTags(span ot.Span) {
+	for _, key := range opts.baggageTags {
+		if value := span.BaggageItem(key); value != "" {
+			span.SetTag(key, value)
+		}
+	}
+}
+
+// limit returns the header without the baggage items over the limits, and
+// whether any item was dropped. The header passed in is left untouched.
+func (l *BaggageLimits) limit(header http.Header) (http.Header, bool) {
+	prefix := strings.ToLower(l.HeaderPrefix)
+	var keys []string
+	for key := range header {
+		if strings.HasPrefix(strings.ToLower(key), prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var items, size int
+	for i, key := range keys {
+		for _, value := range header[key] {
+			items++
+			size += len(key) - len(prefix) + len(value)
+		}
+		if l.MaxItems > 0 && items > l.MaxItems || l.MaxBytes > 0 && size > l.MaxBytes {
+			header = header.Clone()
+			for _, dropped := range keys[i:] {
+				delete(header, dropped)
+			}
+			return header, true
+		}
+	}
+	return header, false
+}
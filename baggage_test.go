@@ -0,0 +1,144 @@
+package ottwirp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/stretchr/testify/assert"
+	"github.com/twirp-ecosystem/twirptest"
+)
+
+type tenantKey struct{}
+
+func TestBaggageTags(t *testing.T) {
+	contextBaggage := WithContextBaggage(func(ctx context.Context) []BaggageItem {
+		tenant, _ := ctx.Value(tenantKey{}).(string)
+		return []BaggageItem{{Key: "tenant", Value: tenant}}
+	})
+
+	t.Run("TraceHTTPClient", func(t *testing.T) {
+		tracer := setupMockTracer()
+		hooks := NewOpenTracingHooks(tracer, WithBaggageTags("tenant"))
+		server, client := TraceServerAndTraceClient(twirptest.NoopHatmaker(), hooks, tracer, contextBaggage, WithBaggageTags("tenant"))
+		defer server.Close()
+
+		ctx := context.WithValue(context.Background(), tenantKey{}, "acme")
+		_, err := client.MakeHat(ctx, &twirptest.Size{})
+		if err != nil {
+			t.Fatalf("twirptest client err=%q", err)
+		}
+
+		spans := tracer.FinishedSpans()
+		if assert.Len(t, spans, 2, "expected server and client spans") {
+			assert.Equal(t, "acme", spans[0].Tag("tenant"), "expected the server span to be tagged with the baggage")
+			assert.Equal(t, "acme", spans[1].Tag("tenant"), "expected the client span to be tagged with the baggage")
+		}
+	})
+
+	t.Run("client hooks", func(t *testing.T) {
+		tracer := setupMockTracer()
+		hooks := NewOpenTracingHooks(tracer, WithBaggageTags("tenant"))
+		server := httptest.NewServer(WithTraceContext(twirptest.NewHaberdasherServer(twirptest.NoopHatmaker(), hooks), tracer))
+		defer server.Close()
+		httpClient := NewTraceHTTPClient(http.DefaultClient, tracer)
+		client := hookedHaberdasherClient(server.URL, httpClient, NewOpenTracingClientHooks(tracer, contextBaggage))
+
+		ctx := context.WithValue(context.Background(), tenantKey{}, "acme")
+		_, err := client.MakeHat(ctx, &twirptest.Size{})
+		if err != nil {
+			t.Fatalf("twirptest client err=%q", err)
+		}
+
+		spans := tracer.FinishedSpans()
+		if assert.Len(t, spans, 2, "expected server and client spans") {
+			assert.Equal(t, "acme", spans[0].Tag("tenant"), "expected the server span to be tagged with the baggage")
+			assert.Equal(t, "acme", spans[1].BaggageItem("tenant"), "expected the client span to carry the baggage")
+		}
+	})
+}
+
+func TestBaggageLimits(t *testing.T) {
+	tests := []struct {
+		desc      string
+		limits    BaggageLimits
+		noPrefix  bool
+		repeatA   bool
+		baggage   map[string]string
+		truncated bool
+	}{
+		{
+			desc:    "keeps baggage within the limits",
+			limits:  BaggageLimits{MaxItems: 3, MaxBytes: 64},
+			baggage: map[string]string{"a": "1", "b": "2", "c": "3"},
+		},
+		{
+			desc:      "drops items over the count limit",
+			limits:    BaggageLimits{MaxItems: 2},
+			baggage:   map[string]string{"a": "1", "b": "2"},
+			truncated: true,
+		},
+		{
+			desc:      "drops items over the size limit",
+			limits:    BaggageLimits{MaxBytes: 5},
+			baggage:   map[string]string{"a": "1", "b": "2"},
+			truncated: true,
+		},
+		{
+			desc:      "counts every value of repeated headers",
+			limits:    BaggageLimits{MaxItems: 3},
+			repeatA:   true,
+			baggage:   map[string]string{"a": "1", "b": "2"},
+			truncated: true,
+		},
+		{
+			desc:     "does not apply the limits to every header without a prefix",
+			limits:   BaggageLimits{MaxItems: 1},
+			noPrefix: true,
+			baggage:  map[string]string{"a": "1", "b": "2", "c": "3"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			tracer := setupMockTracer()
+			parent := tracer.StartSpan("parent")
+			parent.SetBaggageItem("a", "1")
+			parent.SetBaggageItem("b", "2")
+			parent.SetBaggageItem("c", "3")
+			header := http.Header{}
+			_ = tracer.Inject(parent.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(header))
+
+			if tt.repeatA {
+				header.Add("Mockpfx-Baggage-A", "1")
+			}
+
+			if !tt.noPrefix {
+				tt.limits.HeaderPrefix = "mockpfx-baggage-"
+			}
+			hooks := NewOpenTracingHooks(tracer, WithBaggageLimits(tt.limits))
+			handler := WithTraceContext(twirptest.NewHaberdasherServer(twirptest.NoopHatmaker(), hooks), tracer)
+
+			req := httptest.NewRequest("POST", "/twirp/twirptest.Haberdasher/MakeHat", nil)
+			req.Header = header
+			req.Header.Set("Content-Type", "application/protobuf")
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			spans := tracer.FinishedSpans()
+			if !assert.Len(t, spans, 1, "expected a server span") {
+				return
+			}
+			spanContext := spans[0].Context().(mocktracer.MockSpanContext)
+			assert.Equal(t, tt.baggage, spanContext.Baggage, "expected baggage to match")
+			if tt.truncated {
+				assert.Equal(t, true, spans[0].Tag("baggage.truncated"), "expected the span to be tagged as truncated")
+			} else {
+				assert.Nil(t, spans[0].Tag("baggage.truncated"), "expected the span not to be tagged as truncated")
+			}
+			assert.Equal(t, "3", req.Header.Get("Mockpfx-Baggage-C"), "expected the request headers to be left untouched")
+		})
+	}
+}
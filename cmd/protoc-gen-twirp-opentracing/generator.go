@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	ottwirp "github.com/twirp-ecosystem/twirp-opentracing"
+	"google.golang.org/protobuf/compiler/protogen"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// spanTag is a request field set as a span tag.
+type spanTag struct {
+	name string
+	// expr is the Go expression returning the field value from req.
+	expr string
+}
+
+func generateFile(gen *protogen.Plugin, file *protogen.File) error {
+	if len(file.Services) == 0 {
+		return nil
+	}
+
+	tags := make(map[*protogen.Method][]spanTag)
+	var hasTags bool
+	for _, service := range file.Services {
+		for _, method := range service.Methods {
+			methodTags, err := requestTags(method.Input, "req", nil)
+			if err != nil {
+				return fmt.Errorf("%s: %v", method.Desc.FullName(), err)
+			}
+			tags[method] = methodTags
+			hasTags = hasTags || len(methodTags) != 0
+		}
+	}
+
+	g := gen.NewGeneratedFile(file.GeneratedFilenamePrefix+".ottwirp.go", file.GoImportPath)
+	g.P("// Code generated by protoc-gen-twirp-opentracing. DO NOT EDIT.")
+	g.P("// source: ", file.Desc.Path())
+	g.P()
+	g.P("package ", file.GoPackageName)
+	g.P()
+	// The import paths do not end with the package names, so the imports are
+	// named here rather than by protogen.
+	g.P("import (")
+	g.P(`context "context"`)
+	g.P()
+	if hasTags {
+		g.P(`opentracing "github.com/opentracing/opentracing-go"`)
+	}
+	g.P(`ottwirp "github.com/twirp-ecosystem/twirp-opentracing"`)
+	g.P(")")
+	g.P()
+
+	for _, service := range file.Services {
+		if err := generateService(g, file, service, tags); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func generateService(g *protogen.GeneratedFile, file *protogen.File, service *protogen.Service, tags map[*protogen.Method][]spanTag) error {
+	name := service.GoName
+	traced := "traced" + name
+
+	g.P("// NewTraced", name, " wraps a ", name, " so the span of each call, started by")
+	g.P("// the ottwirp server hooks, is tagged with the request fields declared with")
+	g.P("// the (ottwirp.tag) option.")
+	g.P("func NewTraced", name, "(next ", name, ") ", name, " {")
+	g.P("return &", traced, "{next: next}")
+	g.P("}")
+	g.P()
+	g.P("type ", traced, " struct {")
+	g.P("next ", name)
+	g.P("}")
+	g.P()
+
+	var skipped, sampled []*protogen.Method
+	for _, method := range service.Methods {
+		g.P("func (s *", traced, ") ", method.GoName, "(ctx context.Context, req *", g.QualifiedGoIdent(method.Input.GoIdent),
+			") (*", g.QualifiedGoIdent(method.Output.GoIdent), ", error) {")
+		if len(tags[method]) != 0 {
+			g.P("if span := opentracing.SpanFromContext(ctx); span != nil {")
+			for _, tag := range tags[method] {
+				g.P("span.SetTag(", strconv.Quote(tag.name), ", ", tag.expr, ")")
+			}
+			g.P("}")
+		}
+		g.P("return s.next.", method.GoName, "(ctx, req)")
+		g.P("}")
+		g.P()
+
+		options := methodOptions(method)
+		switch {
+		case options.GetSkip():
+			skipped = append(skipped, method)
+		case options != nil && options.SampleRate != nil:
+			rate := options.GetSampleRate()
+			if rate < 0 || rate > 1 {
+				return fmt.Errorf("%s: (ottwirp.method).sample_rate must be between 0 and 1, got %v", method.Desc.FullName(), rate)
+			}
+			sampled = append(sampled, method)
+		}
+	}
+
+	g.P("// ", name, "TraceOptions returns the trace options declared with the")
+	g.P("// (ottwirp.method) options of the ", name, " methods, to pass to")
+	g.P("// ottwirp.NewOpenTracingHooks.")
+	g.P("func ", name, "TraceOptions() []ottwirp.TraceOption {")
+	if len(skipped) == 0 && len(sampled) == 0 {
+		g.P("return nil")
+		g.P("}")
+		g.P()
+		return nil
+	}
+	g.P("return []ottwirp.TraceOption{")
+	if len(skipped) != 0 {
+		g.P("ottwirp.DenyMethods(")
+		for _, method := range skipped {
+			g.P(methodRule(file, service, method), ",")
+		}
+		g.P("),")
+	}
+	for _, method := range sampled {
+		rate := methodOptions(method).GetSampleRate()
+		g.P("ottwirp.SampleMethods(", strconv.FormatFloat(rate, 'g', -1, 64), ", ", methodRule(file, service, method), "),")
+	}
+	g.P("}")
+	g.P("}")
+	g.P()
+	return nil
+}
+
+func methodRule(file *protogen.File, service *protogen.Service, method *protogen.Method) string {
+	return fmt.Sprintf("ottwirp.MethodRule{Package: %q, Service: %q, Method: %q}",
+		file.Desc.Package(), service.Desc.Name(), method.Desc.Name())
+}
+
+// methodOptions returns the (ottwirp.method) options of method, if any.
+func methodOptions(method *protogen.Method) *ottwirp.MethodOptions {
+	options, _ := proto.GetExtension(method.Desc.Options(), ottwirp.E_Method).(*ottwirp.MethodOptions)
+	return options
+}
+
+// requestTags returns the fields of message annotated with (ottwirp.tag),
+// looking into nested messages. getter is the Go expression of the message,
+// and path holds the messages being visited, to stop at recursive messages.
+func requestTags(message *protogen.Message, getter string, path map[protoreflect.FullName]bool) ([]spanTag, error) {
+	if path[message.Desc.FullName()] {
+		return nil, nil
+	}
+	if path == nil {
+		path = make(map[protoreflect.FullName]bool)
+	}
+	path[message.Desc.FullName()] = true
+	defer delete(path, message.Desc.FullName())
+
+	var tags []spanTag
+	for _, field := range message.Fields {
+		expr := getter + ".Get" + field.GoName + "()"
+		singular := !field.Desc.IsList() && !field.Desc.IsMap()
+
+		if name := proto.GetExtension(field.Desc.Options(), ottwirp.E_Tag).(string); name != "" {
+			switch kind := field.Desc.Kind(); {
+			case !singular, kind == protoreflect.MessageKind, kind == protoreflect.GroupKind, kind == protoreflect.BytesKind:
+				return nil, fmt.Errorf("field %s: (ottwirp.tag) is only supported on singular scalar, string and enum fields", field.Desc.FullName())
+			case kind == protoreflect.EnumKind:
+				tags = append(tags, spanTag{name: name, expr: expr + ".String()"})
+			default:
+				tags = append(tags, spanTag{name: name, expr: expr})
+			}
+		}
+
+		if field.Message != nil && singular {
+			nested, err := requestTags(field.Message, expr, path)
+			if err != nil {
+				return nil, err
+			}
+			tags = append(tags, nested...)
+		}
+	}
+	return tags, nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bufbuild/protocompile"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/compiler/protogen"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/pluginpb"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+const goldenFile = "testdata/service.ottwirp.go.golden"
+
+func TestGenerate(t *testing.T) {
+	content, err := generate(t, "")
+	if err != nil {
+		t.Fatalf("generate err=%q", err)
+	}
+
+	if *update {
+		if err := os.WriteFile(goldenFile, []byte(content), 0o644); err != nil {
+			t.Fatalf("os.WriteFile err=%q", err)
+		}
+	}
+	golden, err := os.ReadFile(goldenFile)
+	if err != nil {
+		t.Fatalf("os.ReadFile err=%q", err)
+	}
+	assert.Equal(t, string(golden), content, "expected the generated code to match %s, run go test -update to update it", goldenFile)
+}
+
+func TestGenerateOptions(t *testing.T) {
+	tests := []struct {
+		desc     string
+		replace  []string
+		expected string
+		err      string
+	}{
+		{
+			desc:    "skipped methods are denied",
+			replace: []string{"option (ottwirp.method).sample_rate = 0.5;", "option (ottwirp.method).skip = true;"},
+			expected: `ottwirp.DenyMethods(
+			ottwirp.MethodRule{Package: "twirptest", Service: "Haberdasher", Method: "MakeHat"},
+		),`,
+		},
+		{
+			desc:     "methods without options return no options",
+			replace:  []string{"option (ottwirp.method).sample_rate = 0.5;", ""},
+			expected: "return nil",
+		},
+		{
+			desc:    "sample rates must be between 0 and 1",
+			replace: []string{"option (ottwirp.method).sample_rate = 0.5;", "option (ottwirp.method).sample_rate = 2;"},
+			err:     "twirptest.Haberdasher.MakeHat: (ottwirp.method).sample_rate must be between 0 and 1, got 2",
+		},
+		{
+			desc:    "tags are not supported on repeated fields",
+			replace: []string{"int32 inches = 1", "repeated int32 inches = 1"},
+			err:     "twirptest.Haberdasher.MakeHat: field twirptest.Size.inches: (ottwirp.tag) is only supported on singular scalar, string and enum fields",
+		},
+		{
+			desc: "tags are read from nested messages",
+			replace: []string{"message Size {", `message Size {
+  Hat hat = 2;`, "string color = 2;", `string color = 2 [(ottwirp.tag) = "hat.color"];`},
+			expected: `span.SetTag("hat.color", req.GetHat().GetColor())`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			source, err := os.ReadFile("testdata/service.proto")
+			if err != nil {
+				t.Fatalf("os.ReadFile err=%q", err)
+			}
+
+			content, err := generate(t, strings.NewReplacer(tt.replace...).Replace(string(source)))
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			if err != nil {
+				t.Fatalf("generate err=%q", err)
+			}
+			assert.Contains(t, content, tt.expected)
+		})
+	}
+}
+
+// TestGeneratedCode builds the golden file along with the twirptest package
+// and runs a test of the generated decorator in a temporary module.
+func TestGeneratedCode(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping the build of the generated code in short mode")
+	}
+
+	root, err := filepath.Abs("../..")
+	if err != nil {
+		t.Fatalf("filepath.Abs err=%q", err)
+	}
+	twirptestDir, err := exec.Command("go", "list", "-m", "-f", "{{.Dir}}", "github.com/twirp-ecosystem/twirptest").Output()
+	if err != nil {
+		t.Fatalf("go list err=%q", err)
+	}
+
+	dir := t.TempDir()
+	for _, name := range []string{"service.pb.go", "service.twirp.go", "hatmakers.go"} {
+		copyFile(t, filepath.Join(strings.TrimSpace(string(twirptestDir)), name), filepath.Join(dir, name))
+	}
+	copyFile(t, goldenFile, filepath.Join(dir, "service.ottwirp.go"))
+	copyFile(t, filepath.Join(root, "go.sum"), filepath.Join(dir, "go.sum"))
+	copyFile(t, "testdata/generated_test.go.txt", filepath.Join(dir, "generated_test.go"))
+	writeFile(t, filepath.Join(dir, "go.mod"), `module github.com/twirp-ecosystem/twirptest
+
+go 1.22.0
+
+require github.com/twirp-ecosystem/twirp-opentracing v0.0.0
+
+replace github.com/twirp-ecosystem/twirp-opentracing => `+root+"\n")
+
+	for _, args := range [][]string{{"mod", "tidy"}, {"test", "./..."}} {
+		cmd := exec.Command("go", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("go %s err=%q\n%s", strings.Join(args, " "), err, out)
+		}
+	}
+}
+
+// generate runs the plugin on testdata/service.proto, or on source if it is
+// not empty, and returns the generated file.
+func generate(t *testing.T, source string) (string, error) {
+	compiler := protocompile.Compiler{
+		Resolver: protocompile.WithStandardImports(&protocompile.SourceResolver{
+			ImportPaths: []string{"testdata", "../../proto"},
+			Accessor: func(path string) (io.ReadCloser, error) {
+				if source != "" && path == filepath.Join("testdata", "service.proto") {
+					return io.NopCloser(strings.NewReader(source)), nil
+				}
+				return os.Open(path)
+			},
+		}),
+		SourceInfoMode: protocompile.SourceInfoStandard,
+	}
+	files, err := compiler.Compile(context.Background(), "service.proto")
+	if err != nil {
+		t.Fatalf("protocompile err=%q", err)
+	}
+
+	req := &pluginpb.CodeGeneratorRequest{
+		FileToGenerate: []string{"service.proto"},
+		Parameter:      stringPtr("Mservice.proto=github.com/twirp-ecosystem/twirptest"),
+		ProtoFile:      fileDescriptorProtos(files[0], map[string]bool{}),
+	}
+	// protoc sends the request encoded, so the options are decoded into the
+	// generated option types, as they are when the plugin runs.
+	b, err := proto.Marshal(req)
+	if err != nil {
+		t.Fatalf("proto.Marshal err=%q", err)
+	}
+	req = &pluginpb.CodeGeneratorRequest{}
+	if err := proto.Unmarshal(b, req); err != nil {
+		t.Fatalf("proto.Unmarshal err=%q", err)
+	}
+	gen, err := protogen.Options{}.New(req)
+	if err != nil {
+		t.Fatalf("protogen err=%q", err)
+	}
+	for _, file := range gen.Files {
+		if file.Generate {
+			if err := generateFile(gen, file); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	res := gen.Response()
+	if res.Error != nil {
+		t.Fatalf("protogen err=%q", res.GetError())
+	}
+	if len(res.File) != 1 {
+		t.Fatalf("expected a single generated file, got %d", len(res.File))
+	}
+	assert.Equal(t, "github.com/twirp-ecosystem/twirptest/service.ottwirp.go", res.File[0].GetName())
+	return res.File[0].GetContent(), nil
+}
+
+// fileDescriptorProtos returns the descriptors of file and its imports, with
+// imports first as protoc does.
+func fileDescriptorProtos(file protoreflect.FileDescriptor, seen map[string]bool) []*descriptorpb.FileDescriptorProto {
+	if seen[file.Path()] {
+		return nil
+	}
+	seen[file.Path()] = true
+
+	var protos []*descriptorpb.FileDescriptorProto
+	imports := file.Imports()
+	for i := 0; i < imports.Len(); i++ {
+		protos = append(protos, fileDescriptorProtos(imports.Get(i).FileDescriptor, seen)...)
+	}
+	return append(protos, protodesc.ToFileDescriptorProto(file))
+}
+
+func copyFile(t *testing.T, src, dst string) {
+	b, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatalf("os.ReadFile err=%q", err)
+	}
+	writeFile(t, dst, string(b))
+}
+
+func writeFile(t *testing.T, name, content string) {
+	if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+		t.Fatalf("os.WriteFile err=%q", err)
+	}
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
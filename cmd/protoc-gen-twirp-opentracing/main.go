@@ -0,0 +1,36 @@
+// Command protoc-gen-twirp-opentracing generates tracing decorators for Twirp
+// services from the options declared in proto/ottwirp/options.proto.
+//
+// For each service it generates:
+//
+//   - NewTraced<Service>, which wraps the service implementation and tags the
+//     span of each call with the request fields annotated with (ottwirp.tag).
+//   - <Service>TraceOptions, which returns the ottwirp.TraceOption values
+//     implementing the skip and sample_rate fields of the (ottwirp.method)
+//     options, to pass to ottwirp.NewOpenTracingHooks.
+//
+// The generated code goes in the same package as the code generated by
+// protoc-gen-go and protoc-gen-twirp:
+//
+//	protoc -I proto -I . --go_out=. --twirp_out=. --twirp-opentracing_out=. service.proto
+package main
+
+import (
+	"google.golang.org/protobuf/compiler/protogen"
+	"google.golang.org/protobuf/types/pluginpb"
+)
+
+func main() {
+	protogen.Options{}.Run(func(gen *protogen.Plugin) error {
+		gen.SupportedFeatures = uint64(pluginpb.CodeGeneratorResponse_FEATURE_PROTO3_OPTIONAL)
+		for _, file := range gen.Files {
+			if !file.Generate {
+				continue
+			}
+			if err := generateFile(gen, file); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,507 @@
+package ottwirp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix is the prefix of the environment variables read by Config.LoadEnv.
+const EnvPrefix = "OTTWIRP_"
+
+// Config is a declarative form of the trace options, which can be loaded from
+// YAML or JSON with ParseConfig and from environment variables with LoadEnv,
+// then turned into options with TraceOptions.
+//
+// Methods are selected with rules of the form "[package.]Service/Method",
+// where the service or the method can be "*" to match any, such as
+// "twirptest.Haberdasher/MakeHat", "Health/*" or "*/Poll".
+type Config struct {
+	// Tags are set on every span, see WithTags.
+	Tags map[string]string `yaml:"tags"`
+
+	// IncludeClientErrors and IncludeCancellations default to true when not
+	// set, see IncludeClientErrors and IncludeCancellations.
+	IncludeClientErrors  *bool `yaml:"include_client_errors"`
+	IncludeCancellations *bool `yaml:"include_cancellations"`
+
+	DecodeErrorResponses bool     `yaml:"decode_error_responses"`
+	IncludePayloadSizes  bool     `yaml:"include_payload_sizes"`
+	IncludeErrorCause    bool     `yaml:"include_error_cause"`
+	RedactedMetaKeys     []string `yaml:"redacted_meta_keys"`
+
+	// AllowMethods and DenyMethods are method rules, see AllowMethods and
+	// DenyMethods.
+	AllowMethods []string `yaml:"allow_methods"`
+	DenyMethods  []string `yaml:"deny_methods"`
+
+	// Sampling traces the methods matching the rules of each entry with its
+	// rate, see SampleMethods.
+	Sampling []SamplingConfig `yaml:"sampling"`
+
+	BaggageTags []string `yaml:"baggage_tags"`
+
+	// LifecyclePhases is "none", "logs" or "spans", see WithLifecyclePhases.
+	LifecyclePhases string `yaml:"lifecycle_phases"`
+
+	// MaxSpanLifetime is a duration such as "30s", see WithMaxSpanLifetime.
+	MaxSpanLifetime string `yaml:"max_span_lifetime"`
+
+	// TrustProxies and TrustedProxies take the peer address of server spans
+	// from the forwarded headers, see TrustProxies and TrustedProxies.
+	// TrustedProxies are networks such as "10.0.0.0/8".
+	TrustProxies   bool     `yaml:"trust_proxies"`
+	TrustedProxies []string `yaml:"trusted_proxies"`
+
+	// envKeys maps the keys set by LoadEnv to their environment variable,
+	// to name them in validation errors.
+	envKeys map[string]string
+}
+
+// SamplingConfig is an entry of Config.Sampling.
+type SamplingConfig struct {
+	Methods []string `yaml:"methods"`
+	Rate    float64  `yaml:"rate"`
+}
+
+// ConfigError is returned for an invalid configuration value. Key is the
+// configuration key, such as "deny_methods[1]", or the environment variable,
+// such as "OTTWIRP_DENY_METHODS", the value comes from.
+type ConfigError struct {
+	Key string
+	Err error
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("ottwirp: invalid config %s: %v", e.Key, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// ParseConfig parses and validates a YAML or JSON configuration. Unknown keys
+// and values of the wrong type are rejected with a *ConfigError naming them.
+func ParseConfig(data []byte) (*Config, error) {
+	var document yaml.Node
+	if err := yaml.NewDecoder(bytes.NewReader(data)).Decode(&document); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("ottwirp: invalid config: %w", err)
+	}
+
+	config := &Config{}
+	if len(document.Content) != 0 {
+		if err := decodeConfigNode(document.Content[0], reflect.ValueOf(config).Elem(), ""); err != nil {
+			return nil, err
+		}
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// decodeConfigNode decodes node into v, the value at key, walking mappings
+// and sequences so that an unknown key or a value of the wrong type is
+// reported with the key it is found at, such as "sampling[0].rate".
+func decodeConfigNode(node *yaml.Node, v reflect.Value, key string) error {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+
+	switch {
+	case v.Kind() == reflect.Struct && node.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			name := node.Content[i].Value
+			fieldKey := name
+			if key != "" {
+				fieldKey = key + "." + name
+			}
+			field, ok := configField(v, name)
+			if !ok {
+				return &ConfigError{Key: fieldKey, Err: errors.New("unknown key")}
+			}
+			if err := decodeConfigNode(node.Content[i+1], field, fieldKey); err != nil {
+				return err
+			}
+		}
+		return nil
+	case v.Kind() == reflect.Slice && node.Kind == yaml.SequenceNode:
+		items := reflect.MakeSlice(v.Type(), len(node.Content), len(node.Content))
+		for i, item := range node.Content {
+			if err := decodeConfigNode(item, items.Index(i), fmt.Sprintf("%s[%d]", key, i)); err != nil {
+				return err
+			}
+		}
+		v.Set(items)
+		return nil
+	}
+
+	if err := node.Decode(v.Addr().Interface()); err != nil {
+		var typeErr *yaml.TypeError
+		if errors.As(err, &typeErr) && len(typeErr.Errors) == 1 {
+			err = errors.New(typeErr.Errors[0])
+		}
+		return &ConfigError{Key: key, Err: err}
+	}
+	return nil
+}
+
+// configField returns the field of the struct v with the given yaml key.
+func configField(v reflect.Value, name string) (reflect.Value, bool) {
+	for i := 0; i < v.NumField(); i++ {
+		tag, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("yaml"), ",")
+		if tag != "" && tag == name {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// LoadConfigFile parses the YAML or JSON configuration file at path.
+func LoadConfigFile(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(data)
+}
+
+// configEnv lists the keys that can be set from environment variables, named
+// EnvPrefix followed by the upper case key. Lists are comma separated, tags
+// are key=value pairs and sampling entries are rule=rate pairs, such as
+// OTTWIRP_SAMPLING="Health/*=0.01,*/Poll=0.1".
+var configEnv = map[string]func(c *Config, value string) error{
+	"tags": func(c *Config, value string) error {
+		c.Tags = map[string]string{}
+		for _, pair := range splitList(value) {
+			key, value, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("%q is not a key=value pair", pair)
+			}
+			c.Tags[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+		return nil
+	},
+	"include_client_errors": func(c *Config, value string) error {
+		b, err := strconv.ParseBool(value)
+		c.IncludeClientErrors = &b
+		return err
+	},
+	"include_cancellations": func(c *Config, value string) error {
+		b, err := strconv.ParseBool(value)
+		c.IncludeCancellations = &b
+		return err
+	},
+	"decode_error_responses": boolEnv(func(c *Config) *bool { return &c.DecodeErrorResponses }),
+	"include_payload_sizes":  boolEnv(func(c *Config) *bool { return &c.IncludePayloadSizes }),
+	"include_error_cause":    boolEnv(func(c *Config) *bool { return &c.IncludeErrorCause }),
+	"trust_proxies":          boolEnv(func(c *Config) *bool { return &c.TrustProxies }),
+	"trusted_proxies":        listEnv(func(c *Config) *[]string { return &c.TrustedProxies }),
+	"redacted_meta_keys":     listEnv(func(c *Config) *[]string { return &c.RedactedMetaKeys }),
+	"allow_methods":          listEnv(func(c *Config) *[]string { return &c.AllowMethods }),
+	"deny_methods":           listEnv(func(c *Config) *[]string { return &c.DenyMethods }),
+	"baggage_tags":           listEnv(func(c *Config) *[]string { return &c.BaggageTags }),
+	"sampling": func(c *Config, value string) error {
+		c.Sampling = nil
+		for _, pair := range splitList(value) {
+			rule, rate, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("%q is not a rule=rate pair", pair)
+			}
+			r, err := strconv.ParseFloat(strings.TrimSpace(rate), 64)
+			if err != nil {
+				return err
+			}
+			c.Sampling = append(c.Sampling, SamplingConfig{Methods: []string{strings.TrimSpace(rule)}, Rate: r})
+		}
+		return nil
+	},
+	"lifecycle_phases": func(c *Config, value string) error {
+		c.LifecyclePhases = value
+		return nil
+	},
+	"max_span_lifetime": func(c *Config, value string) error {
+		c.MaxSpanLifetime = value
+		return nil
+	},
+}
+
+func boolEnv(field func(c *Config) *bool) func(c *Config, value string) error {
+	return func(c *Config, value string) (err error) {
+		*field(c), err = strconv.ParseBool(value)
+		return err
+	}
+}
+
+func listEnv(field func(c *Config) *[]string) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		*field(c) = splitList(value)
+		return nil
+	}
+}
+
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// LoadEnv overrides the configuration with the OTTWIRP_* environment
+// variables, such as OTTWIRP_DENY_METHODS for deny_methods. Unknown OTTWIRP_*
+// variables are rejected.
+func (c *Config) LoadEnv() error {
+	var names []string
+	for _, env := range os.Environ() {
+		if name, _, _ := strings.Cut(env, "="); strings.HasPrefix(name, EnvPrefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		key := strings.ToLower(strings.TrimPrefix(name, EnvPrefix))
+		set, ok := configEnv[key]
+		if !ok {
+			return &ConfigError{Key: name, Err: errors.New("unknown variable")}
+		}
+		if err := set(c, os.Getenv(name)); err != nil {
+			return &ConfigError{Key: name, Err: err}
+		}
+		if c.envKeys == nil {
+			c.envKeys = make(map[string]string)
+		}
+		c.envKeys[key] = name
+	}
+	return c.Validate()
+}
+
+// configKey names the value at key followed by path, such as "[1]", in
+// validation errors.
+func (c *Config) configKey(key, path string) string {
+	if name, ok := c.envKeys[key]; ok {
+		return name
+	}
+	return key + path
+}
+
+// Validate checks every configuration value, returning a *ConfigError for the
+// first invalid one.
+func (c *Config) Validate() error {
+	tagKeys := make([]string, 0, len(c.Tags))
+	for key := range c.Tags {
+		tagKeys = append(tagKeys, key)
+	}
+	sort.Strings(tagKeys)
+	for _, key := range tagKeys {
+		if key == "" {
+			return &ConfigError{Key: c.configKey("tags", ""), Err: errors.New("tag keys must not be empty")}
+		}
+	}
+
+	for _, list := range []struct {
+		key   string
+		items []string
+	}{
+		{"redacted_meta_keys", c.RedactedMetaKeys},
+		{"baggage_tags", c.BaggageTags},
+	} {
+		for i, item := range list.items {
+			if item == "" {
+				return &ConfigError{Key: c.configKey(list.key, fmt.Sprintf("[%d]", i)), Err: errors.New("must not be empty")}
+			}
+		}
+	}
+
+	if _, err := c.methodRules("allow_methods", c.AllowMethods, ""); err != nil {
+		return err
+	}
+	if _, err := c.methodRules("deny_methods", c.DenyMethods, ""); err != nil {
+		return err
+	}
+	for i, sampling := range c.Sampling {
+		path := fmt.Sprintf("[%d]", i)
+		if sampling.Rate < 0 || sampling.Rate > 1 {
+			return &ConfigError{Key: c.configKey("sampling", path+".rate"), Err: fmt.Errorf("rate must be between 0 and 1, got %v", sampling.Rate)}
+		}
+		if len(sampling.Methods) == 0 {
+			return &ConfigError{Key: c.configKey("sampling", path+".methods"), Err: errors.New("must not be empty")}
+		}
+		if _, err := c.methodRules("sampling", sampling.Methods, path+".methods"); err != nil {
+			return err
+		}
+	}
+
+	if _, err := c.trustedProxies(); err != nil {
+		return err
+	}
+	if _, err := c.lifecyclePhases(); err != nil {
+		return err
+	}
+	if _, err := c.maxSpanLifetime(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// TraceOptions validates the configuration and returns the matching trace
+// options, which can be passed to NewOpenTracingHooks, WithTraceContext,
+// Instrument and NewTraceHTTPClient alike. Options that do not apply to one of
+// them are ignored by it.
+func (c *Config) TraceOptions() ([]TraceOption, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	var opts []TraceOption
+	if c.IncludeClientErrors != nil {
+		opts = append(opts, IncludeClientErrors(*c.IncludeClientErrors))
+	}
+	if c.IncludeCancellations != nil {
+		opts = append(opts, IncludeCancellations(*c.IncludeCancellations))
+	}
+	if c.DecodeErrorResponses {
+		opts = append(opts, DecodeErrorResponses(true))
+	}
+	if c.IncludePayloadSizes {
+		opts = append(opts, IncludePayloadSizes(true))
+	}
+	if c.IncludeErrorCause {
+		opts = append(opts, IncludeErrorCause(true))
+	}
+	if c.TrustProxies {
+		opts = append(opts, TrustProxies(true))
+	}
+	if networks, _ := c.trustedProxies(); len(networks) != 0 {
+		opts = append(opts, TrustedProxies(networks...))
+	}
+
+	if len(c.Tags) != 0 {
+		keys := make([]string, 0, len(c.Tags))
+		for key := range c.Tags {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		tags := make([]TraceTag, 0, len(keys))
+		for _, key := range keys {
+			tags = append(tags, TraceTag{Key: key, Value: c.Tags[key]})
+		}
+		opts = append(opts, WithTags(tags...))
+	}
+	if len(c.RedactedMetaKeys) != 0 {
+		opts = append(opts, WithRedactedMetaKeys(c.RedactedMetaKeys...))
+	}
+	if len(c.BaggageTags) != 0 {
+		opts = append(opts, WithBaggageTags(c.BaggageTags...))
+	}
+
+	// The rules were validated above.
+	if rules, _ := c.methodRules("allow_methods", c.AllowMethods, ""); len(rules) != 0 {
+		opts = append(opts, AllowMethods(rules...))
+	}
+	if rules, _ := c.methodRules("deny_methods", c.DenyMethods, ""); len(rules) != 0 {
+		opts = append(opts, DenyMethods(rules...))
+	}
+	for _, sampling := range c.Sampling {
+		rules, _ := c.methodRules("sampling", sampling.Methods, "")
+		opts = append(opts, SampleMethods(sampling.Rate, rules...))
+	}
+
+	if phases, _ := c.lifecyclePhases(); phases != NoLifecyclePhases {
+		opts = append(opts, WithLifecyclePhases(phases))
+	}
+	if lifetime, _ := c.maxSpanLifetime(); lifetime != 0 {
+		opts = append(opts, WithMaxSpanLifetime(lifetime))
+	}
+	return opts, nil
+}
+
+func (c *Config) methodRules(key string, rules []string, path string) ([]MethodRule, error) {
+	methodRules := make([]MethodRule, 0, len(rules))
+	for i, rule := range rules {
+		methodRule, err := parseMethodRule(rule)
+		if err != nil {
+			return nil, &ConfigError{Key: c.configKey(key, fmt.Sprintf("%s[%d]", path, i)), Err: err}
+		}
+		methodRules = append(methodRules, methodRule)
+	}
+	return methodRules, nil
+}
+
+// parseMethodRule parses a method rule of the form "[package.]Service/Method".
+func parseMethodRule(rule string) (MethodRule, error) {
+	service, method, ok := strings.Cut(rule, "/")
+	if !ok || service == "" || method == "" || strings.Contains(method, "/") {
+		return MethodRule{}, fmt.Errorf("%q is not of the form [package.]Service/Method", rule)
+	}
+
+	var methodRule MethodRule
+	if i := strings.LastIndex(service, "."); i >= 0 {
+		methodRule.Package, service = service[:i], service[i+1:]
+		if methodRule.Package == "" || service == "" {
+			return MethodRule{}, fmt.Errorf("%q is not of the form [package.]Service/Method", rule)
+		}
+	}
+	if service != "*" {
+		methodRule.Service = service
+	}
+	if method != "*" {
+		methodRule.Method = method
+	}
+	return methodRule, nil
+}
+
+func (c *Config) trustedProxies() ([]netip.Prefix, error) {
+	networks := make([]netip.Prefix, 0, len(c.TrustedProxies))
+	for i, network := range c.TrustedProxies {
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			return nil, &ConfigError{Key: c.configKey("trusted_proxies", fmt.Sprintf("[%d]", i)), Err: err}
+		}
+		networks = append(networks, prefix)
+	}
+	return networks, nil
+}
+
+func (c *Config) lifecyclePhases() (LifecyclePhases, error) {
+	switch c.LifecyclePhases {
+	case "", "none":
+		return NoLifecyclePhases, nil
+	case "logs":
+		return LifecycleLogs, nil
+	case "spans":
+		return LifecycleSpans, nil
+	default:
+		return NoLifecyclePhases, &ConfigError{
+			Key: c.configKey("lifecycle_phases", ""),
+			Err: fmt.Errorf("%q is not one of none, logs or spans", c.LifecyclePhases),
+		}
+	}
+}
+
+func (c *Config) maxSpanLifetime() (time.Duration, error) {
+	if c.MaxSpanLifetime == "" {
+		return 0, nil
+	}
+	lifetime, err := time.ParseDuration(c.MaxSpanLifetime)
+	if err == nil && lifetime < 0 {
+		err = fmt.Errorf("%q must not be negative", c.MaxSpanLifetime)
+	}
+	if err != nil {
+		return 0, &ConfigError{Key: c.configKey("max_span_lifetime", ""), Err: err}
+	}
+	return lifetime, nil
+}
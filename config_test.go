@@ -0,0 +1,212 @@
+package ottwirp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/twirp-ecosystem/twirptest"
+)
+
+func TestParseConfig(t *testing.T) {
+	config, err := ParseConfig([]byte(`
+tags:
+  region: eu
+include_client_errors: false
+deny_methods: ["Health/*", "twirptest.Haberdasher/MakeScarf"]
+sampling:
+  - methods: ["*/Poll"]
+    rate: 0.1
+lifecycle_phases: logs
+max_span_lifetime: 30s
+`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, map[string]string{"region": "eu"}, config.Tags)
+	if assert.NotNil(t, config.IncludeClientErrors) {
+		assert.False(t, *config.IncludeClientErrors)
+	}
+	assert.Equal(t, []SamplingConfig{{Methods: []string{"*/Poll"}, Rate: 0.1}}, config.Sampling)
+
+	rules, err := config.methodRules("deny_methods", config.DenyMethods, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []MethodRule{
+		{Service: "Health"},
+		{Package: "twirptest", Service: "Haberdasher", Method: "MakeScarf"},
+	}, rules)
+
+	phases, _ := config.lifecyclePhases()
+	assert.Equal(t, LifecycleLogs, phases)
+	lifetime, _ := config.maxSpanLifetime()
+	assert.Equal(t, 30*time.Second, lifetime)
+
+	json, err := ParseConfig([]byte(`{"tags": {"region": "eu"}, "include_client_errors": false}`))
+	assert.NoError(t, err)
+	assert.Equal(t, config.Tags, json.Tags)
+	assert.Equal(t, config.IncludeClientErrors, json.IncludeClientErrors)
+}
+
+func TestConfigErrors(t *testing.T) {
+	tests := []struct {
+		desc   string
+		config string
+		env    map[string]string
+		key    string
+	}{
+		{
+			desc:   "names invalid method rules",
+			config: `deny_methods: ["Health/*", "MakeHat"]`,
+			key:    "deny_methods[1]",
+		},
+		{
+			desc:   "names invalid sampling rates",
+			config: `sampling: [{methods: ["*/Poll"], rate: 2}]`,
+			key:    "sampling[0].rate",
+		},
+		{
+			desc:   "names invalid sampling rules",
+			config: `sampling: [{methods: ["*/Poll", ".Health/*"], rate: 0.5}]`,
+			key:    "sampling[0].methods[1]",
+		},
+		{
+			desc:   "names values of the wrong type",
+			config: `include_client_errors: maybe`,
+			key:    "include_client_errors",
+		},
+		{
+			desc:   "names nested values of the wrong type",
+			config: `sampling: [{methods: ["*/Poll"], rate: 0.5}, {methods: ["Health/*"], rate: high}]`,
+			key:    "sampling[1].rate",
+		},
+		{
+			desc:   "names unknown nested keys",
+			config: `sampling: [{method: ["*/Poll"], rate: 0.5}]`,
+			key:    "sampling[0].method",
+		},
+		{
+			desc:   "names invalid trusted proxy networks",
+			config: `trusted_proxies: ["10.0.0.0/8", "10.0.0.1"]`,
+			key:    "trusted_proxies[1]",
+		},
+		{
+			desc:   "names unknown lifecycle phases",
+			config: `lifecycle_phases: all`,
+			key:    "lifecycle_phases",
+		},
+		{
+			desc:   "names negative span lifetimes",
+			config: `max_span_lifetime: -1s`,
+			key:    "max_span_lifetime",
+		},
+		{
+			desc: "names the environment variable of invalid values",
+			env:  map[string]string{"OTTWIRP_ALLOW_METHODS": "Health/*,Haberdasher"},
+			key:  "OTTWIRP_ALLOW_METHODS",
+		},
+		{
+			desc: "names environment variables that do not parse",
+			env:  map[string]string{"OTTWIRP_INCLUDE_CLIENT_ERRORS": "maybe"},
+			key:  "OTTWIRP_INCLUDE_CLIENT_ERRORS",
+		},
+		{
+			desc: "names unknown environment variables",
+			env:  map[string]string{"OTTWIRP_SAMPLE_RATE": "0.5"},
+			key:  "OTTWIRP_SAMPLE_RATE",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+
+			config, err := ParseConfig([]byte(tt.config))
+			if err == nil {
+				err = config.LoadEnv()
+			} else {
+				assert.Nil(t, config, "expected no config to be returned with the error")
+			}
+			var configErr *ConfigError
+			if assert.True(t, errors.As(err, &configErr), "expected a *ConfigError, got %v", err) {
+				assert.Equal(t, tt.key, configErr.Key)
+			}
+		})
+	}
+}
+
+func TestConfigUnknownKeys(t *testing.T) {
+	_, err := ParseConfig([]byte(`include_client_error: false`))
+	assert.ErrorContains(t, err, "include_client_error")
+}
+
+func TestConfigLoadEnv(t *testing.T) {
+	t.Setenv("OTTWIRP_TAGS", "region=eu, zone = b")
+	t.Setenv("OTTWIRP_DENY_METHODS", "Health/*")
+	t.Setenv("OTTWIRP_SAMPLING", "*/Poll=0.1,Haberdasher/*=1")
+	t.Setenv("OTTWIRP_INCLUDE_CANCELLATIONS", "false")
+
+	config, err := ParseConfig([]byte(`
+tags: {region: us}
+deny_methods: ["twirptest.Haberdasher/MakeScarf"]
+include_payload_sizes: true
+`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, config.LoadEnv()) {
+		return
+	}
+
+	assert.Equal(t, map[string]string{"region": "eu", "zone": "b"}, config.Tags, "expected the environment to override the file")
+	assert.Equal(t, []string{"Health/*"}, config.DenyMethods)
+	assert.Equal(t, []SamplingConfig{
+		{Methods: []string{"*/Poll"}, Rate: 0.1},
+		{Methods: []string{"Haberdasher/*"}, Rate: 1},
+	}, config.Sampling)
+	if assert.NotNil(t, config.IncludeCancellations) {
+		assert.False(t, *config.IncludeCancellations)
+	}
+	assert.True(t, config.IncludePayloadSizes, "expected keys missing from the environment to be kept")
+}
+
+func TestConfigTraceOptions(t *testing.T) {
+	config, err := ParseConfig([]byte(`
+tags: {region: eu}
+include_payload_sizes: true
+deny_methods: ["twirptest.Haberdasher/MakeScarf"]
+`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	opts, err := config.TraceOptions()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	tracer := setupMockTracer()
+	server := httptest.NewServer(WithTraceContext(twirptest.NewHaberdasherServer(twirptest.NoopHatmaker(), NewOpenTracingHooks(tracer, opts...)), tracer, opts...))
+	defer server.Close()
+	client := twirptest.NewHaberdasherProtobufClient(server.URL, NewTraceHTTPClient(http.DefaultClient, tracer, opts...))
+
+	_, err = client.MakeHat(context.Background(), &twirptest.Size{Inches: 7})
+	assert.NoError(t, err)
+
+	spans := tracer.FinishedSpans()
+	if !assert.Len(t, spans, 2, "expected a server and a client span") {
+		return
+	}
+	for _, span := range spans {
+		assert.Equal(t, "eu", span.Tag("region"))
+		assert.NotNil(t, span.Tag("rpc.request.size"))
+	}
+
+	opts, err = (&Config{LifecyclePhases: "all"}).TraceOptions()
+	assert.Nil(t, opts)
+	assert.Error(t, err, "expected the configuration to be validated")
+}
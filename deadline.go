@@ -0,0 +1,79 @@
+package ottwirp
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	ot "github.com/opentracing/opentracing-go"
+	otlog "github.com/opentracing/opentracing-go/log"
+	"github.com/twitchtv/twirp"
+)
+
+// IncludeCancellations, if set, will report calls canceled by the caller as
+// errors. If not set, canceled calls are only tagged with rpc.canceled. It is
+// set by default.
+func IncludeCancellations(includeCancellations bool) TraceOption {
+	return func(opts *TraceOptions) {
+		opts.includeCancellations = includeCancellations
+	}
+}
+
+// tagDeadline tags the span with the time left before the deadline of ctx, if
+// it has one.
+func tagDeadline(ctx context.Context, span ot.Span) {
+	if deadline, ok := ctx.Deadline(); ok {
+		span.SetTag("rpc.deadline_remaining_ms", time.Until(deadline).Milliseconds())
+	}
+}
+
+// tagContextErr tags the span of a call that failed with err if it was
+// canceled or its deadline exceeded. Calls that did not fail are left alone,
+// even if ctx is done by the time they finish.
+func tagContextErr(ctx context.Context, span ot.Span, err error) {
+	switch {
+	case err == nil:
+	case isCanceled(ctx, err):
+		span.SetTag("rpc.canceled", true)
+	case ctx.Err() == context.DeadlineExceeded || errors.Is(err, context.DeadlineExceeded):
+		span.SetTag("rpc.deadline_exceeded", true)
+	}
+}
+
+// isCanceled reports whether the call failed because it was canceled.
+func isCanceled(ctx context.Context, err error) bool {
+	if ctx.Err() == context.Canceled || errors.Is(err, context.Canceled) {
+		return true
+	}
+	var twerr twirp.Error
+	return errors.As(err, &twerr) && twerr.Code() == twirp.Canceled
+}
+
+// transportErrorCode returns the Twirp error code of a failed round trip.
+func transportErrorCode(err error) twirp.ErrorCode {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return twirp.Canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return twirp.DeadlineExceeded
+	default:
+		return twirp.Internal
+	}
+}
+
+// setTransportErrorSpan records a failed round trip on the span. Cancellations
+// are told apart from network failures, and are only marked as errors if
+// IncludeCancellations is set.
+func setTransportErrorSpan(span ot.Span, err error, opts *TraceOptions) {
+	switch transportErrorCode(err) {
+	case twirp.Canceled:
+		span.SetTag("rpc.canceled", true)
+		if !opts.includeCancellations {
+			span.LogFields(otlog.String("event", "canceled"), otlog.String("message", err.Error()))
+			return
+		}
+	case twirp.DeadlineExceeded:
+		span.SetTag("rpc.deadline_exceeded", true)
+	}
+	setErrorSpan(span, err.Error())
+}
@@ -0,0 +1,178 @@
+package ottwirp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/twirp-ecosystem/twirptest"
+)
+
+func TestTraceHTTPClientCancellations(t *testing.T) {
+	tests := []struct {
+		desc         string
+		traceOpts    []TraceOption
+		service      twirptest.Haberdasher
+		ctx          func() (context.Context, context.CancelFunc)
+		expectedTags map[string]interface{}
+	}{
+		{
+			desc:    "canceled calls are marked as errors by default",
+			service: twirptest.SlowHatmaker(200 * time.Millisecond),
+			ctx: func() (context.Context, context.CancelFunc) {
+				ctx, cancel := context.WithCancel(context.Background())
+				time.AfterFunc(10*time.Millisecond, cancel)
+				return ctx, cancel
+			},
+			expectedTags: map[string]interface{}{
+				"rpc.canceled": true,
+				"error":        true,
+			},
+		},
+		{
+			desc:      "canceled calls are not marked as errors if cancellations are excluded",
+			traceOpts: []TraceOption{IncludeCancellations(false)},
+			service:   twirptest.SlowHatmaker(200 * time.Millisecond),
+			ctx: func() (context.Context, context.CancelFunc) {
+				ctx, cancel := context.WithCancel(context.Background())
+				time.AfterFunc(10*time.Millisecond, cancel)
+				return ctx, cancel
+			},
+			expectedTags: map[string]interface{}{
+				"rpc.canceled": true,
+				"error":        nil,
+			},
+		},
+		{
+			desc:      "calls past their deadline are marked as errors",
+			traceOpts: []TraceOption{IncludeCancellations(false)},
+			service:   twirptest.SlowHatmaker(200 * time.Millisecond),
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), 10*time.Millisecond)
+			},
+			expectedTags: map[string]interface{}{
+				"rpc.deadline_exceeded": true,
+				"error":                 true,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			tracer := setupMockTracer()
+			server := httptest.NewServer(twirptest.NewHaberdasherServer(tt.service, nil))
+			defer server.Close()
+			client := twirptest.NewHaberdasherProtobufClient(server.URL, NewTraceHTTPClient(http.DefaultClient, tracer, tt.traceOpts...))
+
+			ctx, cancel := tt.ctx()
+			defer cancel()
+			_, err := client.MakeHat(ctx, &twirptest.Size{})
+			assert.Error(t, err, "expected the call to fail")
+
+			spans := tracer.FinishedSpans()
+			if !assert.Len(t, spans, 1, "expected a client span") {
+				return
+			}
+			for key, value := range tt.expectedTags {
+				assert.Equal(t, value, spans[0].Tag(key), "expected the %s tag to match", key)
+			}
+		})
+	}
+}
+
+func TestTraceHTTPClientDeadline(t *testing.T) {
+	tracer := setupMockTracer()
+	server := httptest.NewServer(twirptest.NewHaberdasherServer(twirptest.NoopHatmaker(), nil))
+	defer server.Close()
+	client := twirptest.NewHaberdasherProtobufClient(server.URL, NewTraceHTTPClient(http.DefaultClient, tracer))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	_, err := client.MakeHat(ctx, &twirptest.Size{})
+	assert.NoError(t, err)
+
+	spans := tracer.FinishedSpans()
+	if !assert.Len(t, spans, 1, "expected a client span") {
+		return
+	}
+	remaining, _ := spans[0].Tag("rpc.deadline_remaining_ms").(int64)
+	assert.InDelta(t, time.Minute.Milliseconds(), remaining, float64(time.Second.Milliseconds()), "expected the remaining deadline to be tagged")
+	assert.Nil(t, spans[0].Tag("rpc.canceled"), "expected the call not to be canceled")
+}
+
+func TestTraceHTTPClientCanceledAfterResponse(t *testing.T) {
+	tracer := setupMockTracer()
+	server := httptest.NewServer(twirptest.NewHaberdasherServer(twirptest.NoopHatmaker(), nil))
+	defer server.Close()
+	client := NewTraceHTTPClient(http.DefaultClient, tracer)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", server.URL+twirptest.HaberdasherPathPrefix+"MakeHat", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest err=%q", err)
+	}
+	req.Header.Set("Content-Type", "application/protobuf")
+	res, err := client.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	// As when the caller's deferred cancel runs before the body is closed.
+	cancel()
+	res.Body.Close()
+
+	spans := tracer.FinishedSpans()
+	if !assert.Len(t, spans, 1, "expected a client span") {
+		return
+	}
+	assert.Nil(t, spans[0].Tag("rpc.canceled"), "expected the successful call not to be tagged as canceled")
+	assert.Nil(t, spans[0].Tag("error"), "expected the successful call not to be marked as an error")
+}
+
+func TestServerCancellations(t *testing.T) {
+	tests := []struct {
+		desc      string
+		traceOpts []TraceOption
+		error     interface{}
+	}{
+		{
+			desc:  "canceled calls are marked as errors by default",
+			error: true,
+		},
+		{
+			desc:      "canceled calls are not marked as errors if cancellations are excluded",
+			traceOpts: []TraceOption{IncludeCancellations(false)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			tracer := setupMockTracer()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			// The client goes away while the server handles the call.
+			service := twirptest.HaberdasherFunc(func(ctx context.Context, _ *twirptest.Size) (*twirptest.Hat, error) {
+				cancel()
+				return nil, ctx.Err()
+			})
+			hooks := NewOpenTracingHooks(tracer, tt.traceOpts...)
+			handler := WithTraceContext(twirptest.NewHaberdasherServer(service, hooks), tracer)
+
+			req := httptest.NewRequest("POST", "/twirp/twirptest.Haberdasher/MakeHat", nil).WithContext(ctx)
+			req.Header.Set("Content-Type", "application/protobuf")
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			spans := tracer.FinishedSpans()
+			if !assert.Len(t, spans, 1, "expected a server span") {
+				return
+			}
+			remaining, _ := spans[0].Tag("rpc.deadline_remaining_ms").(int64)
+			assert.Greater(t, remaining, int64(0), "expected the remaining deadline to be tagged")
+			assert.Equal(t, true, spans[0].Tag("rpc.canceled"), "expected the call to be tagged as canceled")
+			assert.Equal(t, tt.error, spans[0].Tag("error"), "expected the error tag to match")
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package ottwirp
+
+import (
+	"context"
+	"mime"
+	"net/http"
+
+	ot "github.com/opentracing/opentracing-go"
+)
+
+// Encodings of Twirp calls, tagged as twirp.encoding on spans.
+const (
+	ProtobufEncoding = "protobuf"
+	JSONEncoding     = "json"
+)
+
+type encodingKey struct{}
+
+// Encoding returns the encoding of the Twirp call in ctx, ProtobufEncoding or
+// JSONEncoding, if known. On servers it is known for requests handled by
+// WithTraceContext, and on clients for requests sent by TraceHTTPClient or
+// traced by the hooks from NewOpenTracingClientHooks, so filters set with
+// WithFilter can use it. Client calls made by a handler replace the encoding
+// of the server call with their own.
+func Encoding(ctx context.Context) (string, bool) {
+	encoding, _ := ctx.Value(encodingKey{}).(string)
+	return encoding, encoding != ""
+}
+
+// withEncoding returns a copy of ctx holding the encoding of a request.
+func withEncoding(ctx context.Context, header http.Header) context.Context {
+	return context.WithValue(ctx, encodingKey{}, encodingFromHeader(header))
+}
+
+// encodingFromHeader returns the encoding of a request from its Content-Type,
+// or an empty string if it is not a Twirp encoding.
+func encodingFromHeader(header http.Header) string {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
+
+	switch mediaType {
+	case "application/protobuf":
+		return ProtobufEncoding
+	case "application/json":
+		return JSONEncoding
+	default:
+		return ""
+	}
+}
+
+func setEncodingTag(ctx context.Context, span ot.Span) {
+	if encoding, ok := Encoding(ctx); ok {
+		span.SetTag("twirp.encoding", encoding)
+	}
+}
@@ -0,0 +1,135 @@
+package ottwirp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/stretchr/testify/assert"
+	"github.com/twirp-ecosystem/twirptest"
+)
+
+func TestEncodingTags(t *testing.T) {
+	tests := []struct {
+		desc      string
+		newClient func(url string, client twirptest.HTTPClient) twirptest.Haberdasher
+		encoding  string
+	}{
+		{
+			desc:      "tags protobuf calls",
+			newClient: twirptest.NewHaberdasherProtobufClient,
+			encoding:  ProtobufEncoding,
+		},
+		{
+			desc:      "tags JSON calls",
+			newClient: twirptest.NewHaberdasherJSONClient,
+			encoding:  JSONEncoding,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			tracer := setupMockTracer()
+			hooks := NewOpenTracingHooks(tracer)
+			server := httptest.NewServer(WithTraceContext(twirptest.NewHaberdasherServer(twirptest.NoopHatmaker(), hooks), tracer))
+			defer server.Close()
+			client := tt.newClient(server.URL, NewTraceHTTPClient(http.DefaultClient, tracer))
+
+			_, err := client.MakeHat(context.Background(), &twirptest.Size{})
+			assert.NoError(t, err)
+
+			spans := tracer.FinishedSpans()
+			if !assert.Len(t, spans, 2, "expected a server and a client span") {
+				return
+			}
+			for _, span := range spans {
+				assert.Equal(t, tt.encoding, span.Tag("twirp.encoding"), "expected the encoding to be tagged")
+			}
+		})
+	}
+}
+
+func TestEncodingFilters(t *testing.T) {
+	tracer := setupMockTracer()
+	opts := []TraceOption{DenyMethods(MethodRule{Encoding: JSONEncoding})}
+	hooks := NewOpenTracingHooks(tracer, opts...)
+	server := httptest.NewServer(WithTraceContext(twirptest.NewHaberdasherServer(twirptest.NoopHatmaker(), hooks), tracer))
+	defer server.Close()
+	httpClient := NewTraceHTTPClient(http.DefaultClient, tracer, opts...)
+
+	_, err := twirptest.NewHaberdasherJSONClient(server.URL, httpClient).MakeHat(context.Background(), &twirptest.Size{})
+	assert.NoError(t, err)
+	assert.Empty(t, tracer.FinishedSpans(), "expected JSON calls not to be traced")
+
+	_, err = twirptest.NewHaberdasherProtobufClient(server.URL, httpClient).MakeHat(context.Background(), &twirptest.Size{})
+	assert.NoError(t, err)
+	assert.Len(t, tracer.FinishedSpans(), 2, "expected protobuf calls to be traced")
+}
+
+func TestEncodingOfClientCallsInHandlers(t *testing.T) {
+	tests := []struct {
+		desc      string
+		newClient func(url string, tracer *mocktracer.MockTracer, opts ...TraceOption) twirptest.Haberdasher
+	}{
+		{
+			desc: "calls sent by TraceHTTPClient",
+			newClient: func(url string, tracer *mocktracer.MockTracer, opts ...TraceOption) twirptest.Haberdasher {
+				return twirptest.NewHaberdasherProtobufClient(url, NewTraceHTTPClient(http.DefaultClient, tracer, opts...))
+			},
+		},
+		{
+			desc: "calls traced by the client hooks",
+			newClient: func(url string, tracer *mocktracer.MockTracer, opts ...TraceOption) twirptest.Haberdasher {
+				return hookedHaberdasherClient(url, NewTraceHTTPClient(http.DefaultClient, tracer, opts...), NewOpenTracingClientHooks(tracer, opts...))
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			tracer := setupMockTracer()
+			backend := httptest.NewServer(twirptest.NewHaberdasherServer(twirptest.NoopHatmaker(), nil))
+			defer backend.Close()
+			client := tt.newClient(backend.URL, tracer, DenyMethods(MethodRule{Encoding: JSONEncoding}))
+
+			var serverEncoding string
+			service := twirptest.HaberdasherFunc(func(ctx context.Context, s *twirptest.Size) (*twirptest.Hat, error) {
+				serverEncoding, _ = Encoding(ctx)
+				return client.MakeHat(ctx, s)
+			})
+			server := httptest.NewServer(WithTraceContext(twirptest.NewHaberdasherServer(service, NewOpenTracingHooks(tracer)), tracer))
+			defer server.Close()
+
+			_, err := twirptest.NewHaberdasherJSONClient(server.URL, http.DefaultClient).MakeHat(context.Background(), &twirptest.Size{})
+			assert.NoError(t, err)
+			assert.Equal(t, JSONEncoding, serverEncoding, "expected the handler to see the encoding of the server call")
+
+			spans := tracer.FinishedSpans()
+			if !assert.Len(t, spans, 2, "expected the protobuf client call not to be filtered out") {
+				return
+			}
+			assert.Equal(t, ProtobufEncoding, spans[0].Tag("twirp.encoding"), "expected the client span to be tagged with its own encoding")
+			assert.Equal(t, JSONEncoding, spans[1].Tag("twirp.encoding"), "expected the server span to be tagged with its own encoding")
+		})
+	}
+}
+
+func TestEncodingFromHeader(t *testing.T) {
+	tests := []struct {
+		contentType string
+		encoding    string
+	}{
+		{contentType: "application/protobuf", encoding: ProtobufEncoding},
+		{contentType: "application/json; charset=utf-8", encoding: JSONEncoding},
+		{contentType: "text/plain", encoding: ""},
+		{contentType: "", encoding: ""},
+	}
+
+	for _, tt := range tests {
+		header := http.Header{}
+		header.Set("Content-Type", tt.contentType)
+		assert.Equal(t, tt.encoding, encodingFromHeader(header), "expected the encoding of %q to match", tt.contentType)
+	}
+}
@@ -0,0 +1,109 @@
+package ottwirp
+
+import (
+	"context"
+	"math/rand"
+
+	"github.com/twitchtv/twirp"
+)
+
+// MethodRule selects Twirp methods by package, service and method name, and
+// optionally calls by their encoding, ProtobufEncoding or JSONEncoding. An
+// empty field matches any value, so MethodRule{Service: "Health"} selects every
+// method of the Health service in any package.
+type MethodRule struct {
+	Package  string
+	Service  string
+	Method   string
+	Encoding string
+}
+
+func (r MethodRule) matches(packageName, serviceName, methodName, encoding string) bool {
+	return (r.Package == "" || r.Package == packageName) &&
+		(r.Service == "" || r.Service == serviceName) &&
+		(r.Method == "" || r.Method == methodName) &&
+		(r.Encoding == "" || r.Encoding == encoding)
+}
+
+// WithFilter defines a function that decides whether a call is traced. The
+// function is called with the call's context, which holds the Twirp package,
+// service and method names, and the call is traced only if it returns true.
+// Calling WithFilter multiple times adds filters which must all pass.
+//
+// On the server, the method name is known only once a request is routed, so
+// when filters are set the server span is started from the RequestRouted hook,
+// with its start time set to when the request was received.
+func WithFilter(fn func(ctx context.Context) bool) TraceOption {
+	return func(opts *TraceOptions) {
+		opts.filters = append(opts.filters, fn)
+	}
+}
+
+// AllowMethods restricts tracing to the methods matching any of the rules.
+// Calling AllowMethods multiple times adds to the allow list.
+func AllowMethods(rules ...MethodRule) TraceOption {
+	return func(opts *TraceOptions) {
+		opts.allowMethods = append(opts.allowMethods, rules...)
+	}
+}
+
+// DenyMethods disables tracing for the methods matching any of the rules, even
+// if they are allowed by AllowMethods. Calling DenyMethods multiple times adds
+// to the deny list.
+func DenyMethods(rules ...MethodRule) TraceOption {
+	return func(opts *TraceOptions) {
+		opts.denyMethods = append(opts.denyMethods, rules...)
+	}
+}
+
+// SampleMethods traces the methods matching any of the rules with the given
+// probability, between 0 and 1. Other methods are not affected.
+func SampleMethods(rate float64, rules ...MethodRule) TraceOption {
+	return WithFilter(func(ctx context.Context) bool {
+		if !matchesAny(ctx, rules) {
+			return true
+		}
+		return rand.Float64() < rate
+	})
+}
+
+func (opts *TraceOptions) hasFilters() bool {
+	return len(opts.filters) != 0 || len(opts.allowMethods) != 0 || len(opts.denyMethods) != 0
+}
+
+// shouldTrace reports whether the call in ctx passes the allow and deny lists
+// and every filter function.
+func (opts *TraceOptions) shouldTrace(ctx context.Context) bool {
+	if !opts.hasFilters() {
+		return true
+	}
+
+	if len(opts.allowMethods) != 0 && !matchesAny(ctx, opts.allowMethods) {
+		return false
+	}
+	if matchesAny(ctx, opts.denyMethods) {
+		return false
+	}
+
+	for _, filter := range opts.filters {
+		if !filter(ctx) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesAny reports whether the call in ctx matches any of the rules.
+func matchesAny(ctx context.Context, rules []MethodRule) bool {
+	packageName, _ := twirp.PackageName(ctx)
+	serviceName, _ := twirp.ServiceName(ctx)
+	methodName, _ := twirp.MethodName(ctx)
+	encoding, _ := Encoding(ctx)
+
+	for _, rule := range rules {
+		if rule.matches(packageName, serviceName, methodName, encoding) {
+			return true
+		}
+	}
+	return false
+}
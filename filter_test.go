@@ -0,0 +1,164 @@
+package ottwirp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/twirp-ecosystem/twirptest"
+	"github.com/twitchtv/twirp"
+)
+
+func TestServerFilters(t *testing.T) {
+	tests := []struct {
+		desc      string
+		traceOpts []TraceOption
+		traced    bool
+	}{
+		{
+			desc:      "denied methods are not traced",
+			traceOpts: []TraceOption{DenyMethods(MethodRule{Service: "Haberdasher", Method: "MakeHat"})},
+			traced:    false,
+		},
+		{
+			desc:      "methods missing from the allow list are not traced",
+			traceOpts: []TraceOption{AllowMethods(MethodRule{Method: "Health"})},
+			traced:    false,
+		},
+		{
+			desc:      "allowed methods are traced",
+			traceOpts: []TraceOption{AllowMethods(MethodRule{Package: "twirptest"})},
+			traced:    true,
+		},
+		{
+			desc: "deny list takes precedence over allow list",
+			traceOpts: []TraceOption{
+				AllowMethods(MethodRule{Package: "twirptest"}),
+				DenyMethods(MethodRule{Method: "MakeHat"}),
+			},
+			traced: false,
+		},
+		{
+			desc:      "methods sampled at a rate of 0 are not traced",
+			traceOpts: []TraceOption{SampleMethods(0, MethodRule{Method: "MakeHat"})},
+			traced:    false,
+		},
+		{
+			desc:      "methods sampled at a rate of 1 are traced",
+			traceOpts: []TraceOption{SampleMethods(1, MethodRule{Method: "MakeHat"})},
+			traced:    true,
+		},
+		{
+			desc:      "sampling does not affect other methods",
+			traceOpts: []TraceOption{SampleMethods(0, MethodRule{Method: "MakeScarf"})},
+			traced:    true,
+		},
+		{
+			desc: "calls rejected by a filter function are not traced",
+			traceOpts: []TraceOption{WithFilter(func(ctx context.Context) bool {
+				return false
+			})},
+			traced: false,
+		},
+		{
+			desc: "filter functions see the method name",
+			traceOpts: []TraceOption{WithFilter(func(ctx context.Context) bool {
+				method, _ := twirp.MethodName(ctx)
+				return method == "MakeHat"
+			})},
+			traced: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			tracer := setupMockTracer()
+			hooks := NewOpenTracingHooks(tracer, tt.traceOpts...)
+			// An empty rule matches every method, so the client is not traced.
+			server, client := TraceServerAndTraceClient(twirptest.NoopHatmaker(), hooks, tracer, DenyMethods(MethodRule{}))
+			defer server.Close()
+
+			_, err := client.MakeHat(context.Background(), &twirptest.Size{})
+			if err != nil {
+				t.Fatalf("twirptest client err=%q", err)
+			}
+
+			spans := tracer.FinishedSpans()
+			if !tt.traced {
+				assert.Empty(t, spans, "expected no spans")
+				return
+			}
+			if assert.Len(t, spans, 1, "expected a server span") {
+				assert.Equal(t, "MakeHat", spans[0].OperationName, "expected operation name to be MakeHat")
+				assert.Equal(t, "twirptest", spans[0].Tag("package"), "expected span to be tagged")
+			}
+		})
+	}
+}
+
+func TestServerFiltersUnroutedRequests(t *testing.T) {
+	tracer := setupMockTracer()
+	hooks := NewOpenTracingHooks(tracer, DenyMethods(MethodRule{Method: "MakeHat"}))
+	server := httptest.NewServer(WithTraceContext(twirptest.NewHaberdasherServer(twirptest.NoopHatmaker(), hooks), tracer))
+	defer server.Close()
+
+	res, err := http.Post(server.URL+"/twirp/twirptest.Haberdasher/MakeScarf", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatalf("http.Post err=%q", err)
+	}
+	res.Body.Close()
+
+	spans := tracer.FinishedSpans()
+	if assert.Len(t, spans, 1, "expected a span for the unrouted request") {
+		assert.Equal(t, RequestReceivedEvent, spans[0].OperationName)
+		assert.Equal(t, "bad_route", spans[0].Tag("twirp.error_code"))
+	}
+}
+
+func TestClientFilters(t *testing.T) {
+	deny := DenyMethods(MethodRule{Service: "Haberdasher"})
+
+	t.Run("TraceHTTPClient propagates the parent span of filtered calls", func(t *testing.T) {
+		tracer := setupMockTracer()
+		hooks := NewOpenTracingHooks(tracer)
+		server, client := TraceServerAndTraceClient(twirptest.NoopHatmaker(), hooks, tracer, deny)
+		defer server.Close()
+
+		parent := tracer.StartSpan("parent")
+		ctx := opentracing.ContextWithSpan(context.Background(), parent)
+		_, err := client.MakeHat(ctx, &twirptest.Size{})
+		if err != nil {
+			t.Fatalf("twirptest client err=%q", err)
+		}
+		parent.Finish()
+
+		spans := tracer.FinishedSpans()
+		if assert.Len(t, spans, 2, "expected only the server and parent spans") {
+			assert.Equal(t, "MakeHat", spans[0].OperationName)
+			assert.Equal(t, spans[1].SpanContext.SpanID, spans[0].ParentID, "expected server span to be a child of the parent span")
+		}
+	})
+
+	t.Run("client hooks skip filtered calls", func(t *testing.T) {
+		tracer := setupMockTracer()
+		hooks := NewOpenTracingHooks(tracer)
+		server := httptest.NewServer(WithTraceContext(twirptest.NewHaberdasherServer(twirptest.NoopHatmaker(), hooks), tracer))
+		defer server.Close()
+		httpClient := NewTraceHTTPClient(http.DefaultClient, tracer)
+		client := hookedHaberdasherClient(server.URL, httpClient, NewOpenTracingClientHooks(tracer, deny))
+
+		_, err := client.MakeHat(context.Background(), &twirptest.Size{})
+		if err != nil {
+			t.Fatalf("twirptest client err=%q", err)
+		}
+
+		spans := tracer.FinishedSpans()
+		if assert.Len(t, spans, 1, "expected only the server span") {
+			assert.Equal(t, "MakeHat", spans[0].OperationName)
+		}
+	})
+}
@@ -1,12 +1,31 @@
 module github.com/twirp-ecosystem/twirp-opentracing
 
-go 1.12
+go 1.22.0
 
 require (
-	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/opentracing/opentracing-go v1.0.2
-	github.com/stretchr/testify v1.3.0
+	github.com/bufbuild/protocompile v0.14.1
+	github.com/golang/protobuf v1.5.0
+	github.com/opentracing/opentracing-go v1.2.0
+	github.com/stretchr/testify v1.10.0
 	github.com/twirp-ecosystem/twirptest v0.1.0
-	github.com/twitchtv/twirp v5.6.0+incompatible
-	golang.org/x/net v0.0.0-20190119204137-ed066c81e75e // indirect
+	github.com/twitchtv/twirp v8.1.3+incompatible
+	go.opentelemetry.io/contrib/propagators/jaeger v1.35.0
+	go.opentelemetry.io/otel v1.35.0
+	go.opentelemetry.io/otel/bridge/opentracing v1.35.0
+	go.opentelemetry.io/otel/sdk v1.35.0
+	go.opentelemetry.io/otel/trace v1.35.0
+	google.golang.org/protobuf v1.36.5
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/go-logr/logr v1.4.2 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	go.opentelemetry.io/auto/sdk v1.1.0 // indirect
+	go.opentelemetry.io/otel/metric v1.35.0 // indirect
+	golang.org/x/sync v0.8.0 // indirect
+	golang.org/x/sys v0.30.0 // indirect
 )
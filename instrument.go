@@ -0,0 +1,85 @@
+package ottwirp
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+
+	ot "github.com/opentracing/opentracing-go"
+	"github.com/twitchtv/twirp"
+)
+
+// ErrMissingTraceContext is reported once to the WithErrorHandler function by
+// the server hooks when they handle a request that did not go through
+// WithTraceContext, as inbound span contexts are then ignored and every server
+// span starts a new trace. Without an error handler, it is logged once with the
+// standard logger instead.
+var ErrMissingTraceContext = errors.New("ottwirp: server hooks run without WithTraceContext, inbound span contexts are ignored")
+
+// Instrumentation holds the server hooks and the WithTraceContext wrapper built
+// from the same tracer and options, so the two cannot be configured apart.
+// Use Instrument for a single Twirp server, or an Instrumentation for a mux
+// hosting several:
+//
+//	instrumentation := ottwirp.NewInstrumentation(tracer, opts...)
+//	mux.Handle(haberdasher.HaberdasherPathPrefix, haberdasher.NewHaberdasherServer(hatmaker, instrumentation.Hooks()))
+//	mux.Handle(tailor.TailorPathPrefix, tailor.NewTailorServer(sewer, instrumentation.Hooks()))
+//	http.ListenAndServe(addr, instrumentation.Middleware(mux))
+type Instrumentation struct {
+	tracer ot.Tracer
+	opts   []TraceOption
+	hooks  *twirp.ServerHooks
+}
+
+// NewInstrumentation returns an Instrumentation whose hooks and middleware share
+// the given tracer and options.
+func NewInstrumentation(tracer ot.Tracer, opts ...TraceOption) *Instrumentation {
+	return &Instrumentation{
+		tracer: tracer,
+		opts:   opts,
+		hooks:  NewOpenTracingHooks(tracer, opts...),
+	}
+}
+
+// Hooks returns the server hooks to pass to the generated Twirp servers.
+func (i *Instrumentation) Hooks() *twirp.ServerHooks {
+	return i.hooks
+}
+
+// Middleware wraps a handler serving Twirp servers built with Hooks, see
+// WithTraceContext.
+func (i *Instrumentation) Middleware(next http.Handler) http.Handler {
+	return WithTraceContext(next, i.tracer, i.opts...)
+}
+
+// Instrument builds a Twirp server with newServer, passing it the server hooks,
+// and wraps it with WithTraceContext, both from the given tracer and options:
+//
+//	handler := ottwirp.Instrument(func(hooks *twirp.ServerHooks) http.Handler {
+//		return haberdasher.NewHaberdasherServer(hatmaker, hooks)
+//	}, tracer, opts...)
+//
+// Servers generated by protoc-gen-twirp v8 take the hooks as
+// twirp.WithServerHooks(hooks).
+func Instrument(newServer func(hooks *twirp.ServerHooks) http.Handler, tracer ot.Tracer, opts ...TraceOption) http.Handler {
+	instrumentation := NewInstrumentation(tracer, opts...)
+	return instrumentation.Middleware(newServer(instrumentation.Hooks()))
+}
+
+// checkTraceContext reports ErrMissingTraceContext to the error handler, or
+// logs it if there is none, the first time the hooks handle a request outside
+// of WithTraceContext.
+func (t *TraceServerHooks) checkTraceContext(ctx context.Context) {
+	if tracingInfoFromContext(ctx) != nil {
+		return
+	}
+
+	t.missingTraceContext.Do(func() {
+		if t.opts.errorHandler == nil {
+			log.Print(ErrMissingTraceContext)
+			return
+		}
+		t.opts.errorHandler(ctx, ErrMissingTraceContext)
+	})
+}
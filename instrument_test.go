@@ -0,0 +1,118 @@
+package ottwirp
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/twirp-ecosystem/twirptest"
+	"github.com/twitchtv/twirp"
+)
+
+func TestInstrument(t *testing.T) {
+	tracer := setupMockTracer()
+	handler := Instrument(func(hooks *twirp.ServerHooks) http.Handler {
+		return twirptest.NewHaberdasherServer(twirptest.NoopHatmaker(), hooks)
+	}, tracer, WithTags(TraceTag{Key: "region", Value: "eu"}), IncludePayloadSizes(true))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	client := twirptest.NewHaberdasherProtobufClient(server.URL, NewTraceHTTPClient(http.DefaultClient, tracer))
+
+	_, err := client.MakeHat(context.Background(), &twirptest.Size{Inches: 7})
+	assert.NoError(t, err)
+
+	spans := tracer.FinishedSpans()
+	if !assert.Len(t, spans, 2, "expected a server and a client span") {
+		return
+	}
+	serverSpan, clientSpan := spans[0], spans[1]
+	assert.Equal(t, clientSpan.SpanContext.SpanID, serverSpan.ParentID, "expected the span context to be extracted")
+	assert.Equal(t, "eu", serverSpan.Tag("region"), "expected the hook options to apply")
+	assert.NotNil(t, serverSpan.Tag("rpc.request.size"), "expected the wrapper options to apply")
+}
+
+func TestInstrumentationMiddleware(t *testing.T) {
+	tracer := setupMockTracer()
+	instrumentation := NewInstrumentation(tracer)
+	mux := http.NewServeMux()
+	mux.Handle(twirptest.HaberdasherPathPrefix, twirptest.NewHaberdasherServer(twirptest.NoopHatmaker(), instrumentation.Hooks()))
+	server := httptest.NewServer(instrumentation.Middleware(mux))
+	defer server.Close()
+	client := twirptest.NewHaberdasherProtobufClient(server.URL, NewTraceHTTPClient(http.DefaultClient, tracer))
+
+	_, err := client.MakeHat(context.Background(), &twirptest.Size{})
+	assert.NoError(t, err)
+
+	spans := tracer.FinishedSpans()
+	if assert.Len(t, spans, 2, "expected a server and a client span") {
+		assert.Equal(t, spans[1].SpanContext.SpanID, spans[0].ParentID, "expected the span context to be extracted")
+	}
+}
+
+func TestMissingTraceContext(t *testing.T) {
+	tests := []struct {
+		desc         string
+		wrap         bool
+		errorHandler bool
+		expected     []error
+		logged       string
+	}{
+		{
+			desc:   "logs hooks running without the wrapper once by default",
+			logged: ErrMissingTraceContext.Error() + "\n",
+		},
+		{
+			desc:         "reports hooks running without the wrapper once to the error handler",
+			errorHandler: true,
+			expected:     []error{ErrMissingTraceContext},
+		},
+		{
+			desc: "does not log hooks running within the wrapper",
+			wrap: true,
+		},
+		{
+			desc:         "does not report hooks running within the wrapper",
+			wrap:         true,
+			errorHandler: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			var logged bytes.Buffer
+			log.SetOutput(&logged)
+			log.SetFlags(0)
+			defer func() {
+				log.SetOutput(os.Stderr)
+				log.SetFlags(log.LstdFlags)
+			}()
+
+			tracer := setupMockTracer()
+			var errs []error
+			var opts []TraceOption
+			if tt.errorHandler {
+				opts = append(opts, WithErrorHandler(func(ctx context.Context, err error) {
+					errs = append(errs, err)
+				}))
+			}
+			hooks := NewOpenTracingHooks(tracer, opts...)
+			var handler http.Handler = twirptest.NewHaberdasherServer(twirptest.NoopHatmaker(), hooks)
+			if tt.wrap {
+				handler = WithTraceContext(handler, tracer)
+			}
+
+			for i := 0; i < 2; i++ {
+				req := httptest.NewRequest("POST", "/twirp/twirptest.Haberdasher/MakeHat", nil)
+				req.Header.Set("Content-Type", "application/protobuf")
+				handler.ServeHTTP(httptest.NewRecorder(), req)
+			}
+			assert.Equal(t, tt.expected, errs)
+			assert.Equal(t, tt.logged, logged.String(), "expected the log output to match")
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package ottwirp
+
+import (
+	"context"
+	"unicode/utf8"
+
+	ot "github.com/opentracing/opentracing-go"
+	otlog "github.com/opentracing/opentracing-go/log"
+	"github.com/twitchtv/twirp"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/protoadapt"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+const (
+	RequestMessageEvent  = "request.message"
+	ResponseMessageEvent = "response.message"
+
+	// ClientRequestMessageEvent and ClientResponseMessageEvent are logged by
+	// the interceptor from NewOpenTracingClientInterceptor, so the messages of
+	// outgoing calls are told apart from those of the server call they are
+	// made from.
+	ClientRequestMessageEvent  = "client.request.message"
+	ClientResponseMessageEvent = "client.response.message"
+
+	// DefaultMaxMessageSize is the number of bytes of JSON logged per message
+	// when WithMaxMessageSize is not used.
+	DefaultMaxMessageSize = 4096
+)
+
+// NewOpenTracingInterceptor provides a twirp.Interceptor for servers which
+// logs the request and response messages of each call on the span started by
+// the hooks from NewOpenTracingHooks, as protojson. Install it with
+// twirp.WithServerInterceptors; clients should use
+// NewOpenTracingClientInterceptor instead.
+//
+// Messages may hold sensitive data, so use WithMessageMethods to log the
+// messages of selected methods only, and WithRedactedFields or
+// WithFieldRedactor to hide selected fields.
+func NewOpenTracingInterceptor(opts ...TraceOption) twirp.Interceptor {
+	return newMessageInterceptor(RequestMessageEvent, ResponseMessageEvent, opts)
+}
+
+// NewOpenTracingClientInterceptor provides a twirp.Interceptor for clients
+// which logs the request and response messages of each call as
+// ClientRequestMessageEvent and ClientResponseMessageEvent. Interceptors run
+// before the client hooks, so the messages are logged on the caller's span,
+// such as the server span of the handler making the call. It takes the same
+// options as NewOpenTracingInterceptor.
+func NewOpenTracingClientInterceptor(opts ...TraceOption) twirp.Interceptor {
+	return newMessageInterceptor(ClientRequestMessageEvent, ClientResponseMessageEvent, opts)
+}
+
+func newMessageInterceptor(requestEvent, responseEvent string, opts []TraceOption) twirp.Interceptor {
+	interceptorOpts := &TraceOptions{
+		maxMessageSize: DefaultMaxMessageSize,
+	}
+
+	for _, opt := range opts {
+		opt(interceptorOpts)
+	}
+
+	return func(next twirp.Method) twirp.Method {
+		return func(ctx context.Context, req interface{}) (interface{}, error) {
+			span := ot.SpanFromContext(ctx)
+			if span == nil || !interceptorOpts.shouldLogMessages(ctx) {
+				return next(ctx, req)
+			}
+
+			interceptorOpts.logMessage(span, requestEvent, req)
+			resp, err := next(ctx, req)
+			if err == nil {
+				interceptorOpts.logMessage(span, responseEvent, resp)
+			}
+			return resp, err
+		}
+	}
+}
+
+// WithMessageMethods restricts the messages logged by the interceptors from
+// NewOpenTracingInterceptor and NewOpenTracingClientInterceptor to the methods
+// matching any of the rules. Calling WithMessageMethods multiple times adds to
+// the allow list. Client interceptors run before the request is encoded, so
+// rules with an Encoding are meant for server interceptors only.
+func WithMessageMethods(rules ...MethodRule) TraceOption {
+	return func(opts *TraceOptions) {
+		opts.messageMethods = append(opts.messageMethods, rules...)
+	}
+}
+
+// WithMaxMessageSize sets the number of bytes of JSON logged per message.
+// Longer messages are truncated and logged with message.truncated set. A
+// negative size disables truncation. It defaults to DefaultMaxMessageSize.
+func WithMaxMessageSize(maxSize int) TraceOption {
+	return func(opts *TraceOptions) {
+		opts.maxMessageSize = maxSize
+	}
+}
+
+// WithFieldRedactor defines a function that decides whether a message field is
+// redacted before the message is logged. Redacted string fields are replaced
+// with a placeholder, and other fields are omitted. Calling WithFieldRedactor
+// multiple times adds redactors, and a field is redacted if any of them
+// returns true.
+func WithFieldRedactor(fn func(field protoreflect.FieldDescriptor) bool) TraceOption {
+	return func(opts *TraceOptions) {
+		opts.fieldRedactors = append(opts.fieldRedactors, fn)
+	}
+}
+
+// WithRedactedFields redacts message fields by their full name, such as
+// "twirptest.Hat.color". See WithFieldRedactor.
+func WithRedactedFields(fullNames ...string) TraceOption {
+	redacted := make(map[protoreflect.FullName]bool, len(fullNames))
+	for _, name := range fullNames {
+		redacted[protoreflect.FullName(name)] = true
+	}
+
+	return WithFieldRedactor(func(field protoreflect.FieldDescriptor) bool {
+		return redacted[field.FullName()]
+	})
+}
+
+func (opts *TraceOptions) shouldLogMessages(ctx context.Context) bool {
+	if len(opts.messageMethods) == 0 {
+		return true
+	}
+
+	return matchesAny(ctx, opts.messageMethods)
+}
+
+// logMessage logs msg on the span as JSON, if it is a protobuf message.
+func (opts *TraceOptions) logMessage(span ot.Span, event string, msg interface{}) {
+	var m proto.Message
+	switch msg := msg.(type) {
+	case proto.Message:
+		m = msg
+	case protoadapt.MessageV1:
+		// Messages generated by older versions of protoc-gen-go.
+		m = protoadapt.MessageV2Of(msg)
+	default:
+		return
+	}
+
+	if len(opts.fieldRedactors) != 0 {
+		m = proto.Clone(m)
+		opts.redactFields(m.ProtoReflect())
+	}
+
+	b, err := protojson.Marshal(m)
+	if err != nil {
+		span.LogFields(otlog.String("event", event), otlog.Error(err))
+		return
+	}
+
+	fields := []otlog.Field{otlog.String("event", event)}
+	if json := string(b); opts.maxMessageSize >= 0 && len(json) > opts.maxMessageSize {
+		fields = append(fields, otlog.String("message", truncateUTF8(json, opts.maxMessageSize)), otlog.Bool("message.truncated", true))
+	} else {
+		fields = append(fields, otlog.String("message", json))
+	}
+	span.LogFields(fields...)
+}
+
+// redactFields redacts the fields of m and its nested messages in place.
+func (opts *TraceOptions) redactFields(m protoreflect.Message) {
+	var redacted []protoreflect.FieldDescriptor
+	m.Range(func(field protoreflect.FieldDescriptor, value protoreflect.Value) bool {
+		if opts.isRedacted(field) {
+			redacted = append(redacted, field)
+			return true
+		}
+
+		switch {
+		case field.IsList() && field.Message() != nil:
+			list := value.List()
+			for i := 0; i < list.Len(); i++ {
+				opts.redactFields(list.Get(i).Message())
+			}
+		case field.IsMap() && field.MapValue().Message() != nil:
+			value.Map().Range(func(_ protoreflect.MapKey, value protoreflect.Value) bool {
+				opts.redactFields(value.Message())
+				return true
+			})
+		case field.Message() != nil && !field.IsMap():
+			opts.redactFields(value.Message())
+		}
+		return true
+	})
+
+	for _, field := range redacted {
+		if field.Kind() == protoreflect.StringKind && field.Cardinality() != protoreflect.Repeated {
+			m.Set(field, protoreflect.ValueOfString(redactedValue))
+		} else {
+			m.Clear(field)
+		}
+	}
+}
+
+func (opts *TraceOptions) isRedacted(field protoreflect.FieldDescriptor) bool {
+	for _, redactor := range opts.fieldRedactors {
+		if redactor(field) {
+			return true
+		}
+	}
+	return false
+}
+
+// truncateUTF8 truncates s to at most n bytes without splitting a rune.
+func truncateUTF8(s string, n int) string {
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,197 @@
+package ottwirp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"unicode/utf8"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/stretchr/testify/assert"
+	"github.com/twirp-ecosystem/twirptest"
+	"github.com/twitchtv/twirp"
+	"github.com/twitchtv/twirp/ctxsetters"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+func TestOpenTracingInterceptor(t *testing.T) {
+	makeHat := func(ctx context.Context, req interface{}) (interface{}, error) {
+		size := req.(*twirptest.Size)
+		return &twirptest.Hat{Size: size.Inches, Color: "blue", Name: "fedora"}, nil
+	}
+
+	tests := []struct {
+		desc       string
+		traceOpts  []TraceOption
+		method     twirp.Method
+		expected   map[string]string
+		noMessages bool
+	}{
+		{
+			desc:   "logs request and response messages",
+			method: makeHat,
+			expected: map[string]string{
+				RequestMessageEvent:  `{"inches":10}`,
+				ResponseMessageEvent: `{"size":10,"color":"blue","name":"fedora"}`,
+			},
+		},
+		{
+			desc:   "logs only the request of failed calls",
+			method: twirp.Method(func(ctx context.Context, req interface{}) (interface{}, error) { return nil, errors.New("test") }),
+			expected: map[string]string{
+				RequestMessageEvent: `{"inches":10}`,
+			},
+		},
+		{
+			desc:      "logs messages of allowed methods",
+			traceOpts: []TraceOption{WithMessageMethods(MethodRule{Service: "Haberdasher", Method: "MakeHat"})},
+			method:    makeHat,
+			expected: map[string]string{
+				RequestMessageEvent:  `{"inches":10}`,
+				ResponseMessageEvent: `{"size":10,"color":"blue","name":"fedora"}`,
+			},
+		},
+		{
+			desc:       "skips messages of methods missing from the allow list",
+			traceOpts:  []TraceOption{WithMessageMethods(MethodRule{Method: "MakeScarf"})},
+			method:     makeHat,
+			noMessages: true,
+		},
+		{
+			desc: "redacts fields",
+			traceOpts: []TraceOption{
+				WithRedactedFields("twirptest.Hat.color"),
+				WithFieldRedactor(func(field protoreflect.FieldDescriptor) bool {
+					return field.Name() == "size" || field.Name() == "inches"
+				}),
+			},
+			method: makeHat,
+			expected: map[string]string{
+				RequestMessageEvent:  `{}`,
+				ResponseMessageEvent: `{"color":"[REDACTED]","name":"fedora"}`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			tracer := setupMockTracer()
+			span := tracer.StartSpan("MakeHat")
+			ctx := opentracing.ContextWithSpan(context.Background(), span)
+			ctx = ctxsetters.WithPackageName(ctx, "twirptest")
+			ctx = ctxsetters.WithServiceName(ctx, "Haberdasher")
+			ctx = ctxsetters.WithMethodName(ctx, "MakeHat")
+
+			method := NewOpenTracingInterceptor(tt.traceOpts...)(tt.method)
+			_, _ = method(ctx, &twirptest.Size{Inches: 10})
+			span.Finish()
+
+			messages := loggedMessages(tracer.FinishedSpans()[0])
+			if tt.noMessages {
+				assert.Empty(t, messages, "expected no messages to be logged")
+				return
+			}
+			if assert.Len(t, messages, len(tt.expected), "expected messages to be logged") {
+				for event, expected := range tt.expected {
+					assert.JSONEq(t, expected, messages[event]["message"], "expected the %s to match", event)
+					assert.Empty(t, messages[event]["message.truncated"], "expected the %s not to be truncated", event)
+				}
+			}
+		})
+	}
+}
+
+func TestOpenTracingInterceptorTruncatesMessages(t *testing.T) {
+	tracer := setupMockTracer()
+	span := tracer.StartSpan("MakeHat")
+	ctx := opentracing.ContextWithSpan(context.Background(), span)
+
+	method := NewOpenTracingInterceptor(WithMaxMessageSize(16))(func(ctx context.Context, req interface{}) (interface{}, error) {
+		return &twirptest.Hat{Name: "ушанка"}, nil
+	})
+	_, _ = method(ctx, &twirptest.Size{Inches: 10})
+	span.Finish()
+
+	messages := loggedMessages(tracer.FinishedSpans()[0])
+	assert.Empty(t, messages[RequestMessageEvent]["message.truncated"], "expected short messages not to be truncated")
+
+	response := messages[ResponseMessageEvent]
+	assert.Equal(t, "true", response["message.truncated"], "expected long messages to be truncated")
+	assert.LessOrEqual(t, len(response["message"]), 16, "expected the message to be truncated to the maximum size")
+	assert.Contains(t, response["message"], "уш", "expected the message to be truncated to the maximum size")
+	assert.True(t, utf8.ValidString(response["message"]), "expected the message to be truncated on a rune boundary")
+}
+
+func TestOpenTracingClientInterceptorInHandlers(t *testing.T) {
+	tracer := setupMockTracer()
+	backend := httptest.NewServer(twirptest.NewHaberdasherServer(twirptest.HaberdasherFunc(func(ctx context.Context, s *twirptest.Size) (*twirptest.Hat, error) {
+		return &twirptest.Hat{Size: s.Inches, Name: "bowler"}, nil
+	}), nil))
+	defer backend.Close()
+	client := twirptest.NewHaberdasherProtobufClient(backend.URL, NewTraceHTTPClient(http.DefaultClient, tracer))
+
+	// The interceptors are applied the way code generated by protoc-gen-twirp
+	// v8 applies them.
+	clientMethod := NewOpenTracingClientInterceptor()(func(ctx context.Context, req interface{}) (interface{}, error) {
+		return client.MakeHat(ctx, req.(*twirptest.Size))
+	})
+	serverMethod := NewOpenTracingInterceptor()(func(ctx context.Context, req interface{}) (interface{}, error) {
+		ctx = ctxsetters.WithMethodName(ctx, "MakeHat")
+		hat, err := clientMethod(ctx, &twirptest.Size{Inches: 12})
+		if err != nil {
+			return nil, err
+		}
+		return &twirptest.Hat{Size: hat.(*twirptest.Hat).Size, Name: "fedora"}, nil
+	})
+	service := twirptest.HaberdasherFunc(func(ctx context.Context, s *twirptest.Size) (*twirptest.Hat, error) {
+		hat, err := serverMethod(ctx, s)
+		if err != nil {
+			return nil, err
+		}
+		return hat.(*twirptest.Hat), nil
+	})
+	server := httptest.NewServer(WithTraceContext(twirptest.NewHaberdasherServer(service, NewOpenTracingHooks(tracer)), tracer))
+	defer server.Close()
+
+	_, err := twirptest.NewHaberdasherProtobufClient(server.URL, http.DefaultClient).MakeHat(context.Background(), &twirptest.Size{Inches: 10})
+	assert.NoError(t, err)
+
+	spans := tracer.FinishedSpans()
+	if !assert.Len(t, spans, 2, "expected a client and a server span") {
+		return
+	}
+	assert.Empty(t, loggedMessages(spans[0]), "expected no messages on the client span")
+
+	messages := loggedMessages(spans[1])
+	expected := map[string]string{
+		RequestMessageEvent:        `{"inches":10}`,
+		ResponseMessageEvent:       `{"size":12,"name":"fedora"}`,
+		ClientRequestMessageEvent:  `{"inches":12}`,
+		ClientResponseMessageEvent: `{"size":12,"name":"bowler"}`,
+	}
+	if assert.Len(t, messages, len(expected), "expected the server and client messages to be logged under distinct events") {
+		for event, message := range expected {
+			assert.JSONEq(t, message, messages[event]["message"], "expected the %s to match", event)
+		}
+	}
+}
+
+// loggedMessages returns the fields of the message events logged on the span,
+// by event.
+func loggedMessages(span *mocktracer.MockSpan) map[string]map[string]string {
+	messages := map[string]map[string]string{}
+	for _, record := range span.Logs() {
+		fields := map[string]string{}
+		for _, field := range record.Fields {
+			fields[field.Key] = field.ValueString
+		}
+		switch event := fields["event"]; event {
+		case RequestMessageEvent, ResponseMessageEvent, ClientRequestMessageEvent, ClientResponseMessageEvent:
+			messages[event] = fields
+		}
+	}
+	return messages
+}
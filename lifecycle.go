@@ -0,0 +1,115 @@
+package ottwirp
+
+import (
+	"context"
+	"time"
+
+	ot "github.com/opentracing/opentracing-go"
+	otlog "github.com/opentracing/opentracing-go/log"
+)
+
+const (
+	RequestRoutedEvent    = "request.routed"
+	ResponsePreparedEvent = "response.prepared"
+	ResponseSentEvent     = "response.sent"
+
+	// RoutingPhase spans from the RequestReceived hook to the RequestRouted
+	// hook.
+	RoutingPhase = "twirp.routing"
+	// HandlerPhase spans from the RequestRouted hook to the ResponsePrepared
+	// hook, covering the decoding of the request and the handler itself.
+	HandlerPhase = "twirp.handler"
+	// ResponsePhase spans from the ResponsePrepared hook, or the Error hook, to
+	// the ResponseSent hook, covering the encoding and writing of the response.
+	ResponsePhase = "twirp.response"
+)
+
+// LifecyclePhases selects how the phases of a server request are recorded.
+type LifecyclePhases int
+
+const (
+	// NoLifecyclePhases records the server span only. This is the default.
+	NoLifecyclePhases LifecyclePhases = iota
+	// LifecycleLogs logs RequestRoutedEvent, ResponsePreparedEvent and
+	// ResponseSentEvent on the server span as the hooks are called.
+	LifecycleLogs
+	// LifecycleSpans records RoutingPhase, HandlerPhase and ResponsePhase child
+	// spans of the server span.
+	LifecycleSpans
+)
+
+// WithLifecyclePhases records the phases of server requests, so that slow
+// handlers can be told apart from slow serialization or slow clients reading
+// the response.
+func WithLifecyclePhases(phases LifecyclePhases) TraceOption {
+	return func(opts *TraceOptions) {
+		opts.lifecyclePhases = phases
+	}
+}
+
+func (t *TraceServerHooks) handleResponsePrepared(ctx context.Context) context.Context {
+	t.startResponsePhase(ctx, ResponsePreparedEvent)
+	return ctx
+}
+
+// startHandlerPhase records the end of routing and starts the handler phase.
+func (t *TraceServerHooks) startHandlerPhase(ctx context.Context) {
+	span := ot.SpanFromContext(ctx)
+	call := serverCallFromContext(ctx)
+	if span == nil || call == nil {
+		return
+	}
+
+	switch t.opts.lifecyclePhases {
+	case LifecycleLogs:
+		span.LogFields(otlog.String("event", RequestRoutedEvent))
+	case LifecycleSpans:
+		now := time.Now()
+		routing := span.Tracer().StartSpan(RoutingPhase, ot.ChildOf(span.Context()), ot.StartTime(call.receivedAt))
+		routing.FinishWithOptions(ot.FinishOptions{FinishTime: now})
+		call.phase = span.Tracer().StartSpan(HandlerPhase, ot.ChildOf(span.Context()), ot.StartTime(now))
+	}
+}
+
+// startResponsePhase ends the handler phase, if any, and starts the response
+// phase. event is logged on the span in place of the child span.
+func (t *TraceServerHooks) startResponsePhase(ctx context.Context, event string) {
+	span := ot.SpanFromContext(ctx)
+	call := serverCallFromContext(ctx)
+	if span == nil || call == nil || call.responding {
+		return
+	}
+	call.responding = true
+
+	switch t.opts.lifecyclePhases {
+	case LifecycleLogs:
+		if event != "" {
+			span.LogFields(otlog.String("event", event))
+		}
+	case LifecycleSpans:
+		now := time.Now()
+		if call.phase != nil {
+			call.phase.FinishWithOptions(ot.FinishOptions{FinishTime: now})
+		}
+		call.phase = span.Tracer().StartSpan(ResponsePhase, ot.ChildOf(span.Context()), ot.StartTime(now))
+	}
+}
+
+// finishPhases ends the response phase.
+func (t *TraceServerHooks) finishPhases(ctx context.Context) {
+	span := ot.SpanFromContext(ctx)
+	call := serverCallFromContext(ctx)
+	if span == nil || call == nil {
+		return
+	}
+
+	switch t.opts.lifecyclePhases {
+	case LifecycleLogs:
+		span.LogFields(otlog.String("event", ResponseSentEvent))
+	case LifecycleSpans:
+		if call.phase != nil {
+			call.phase.Finish()
+			call.phase = nil
+		}
+	}
+}
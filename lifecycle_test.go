@@ -0,0 +1,95 @@
+package ottwirp
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/twirp-ecosystem/twirptest"
+	"github.com/twitchtv/twirp"
+)
+
+func TestLifecycleSpans(t *testing.T) {
+	tests := []struct {
+		desc    string
+		service twirptest.Haberdasher
+	}{
+		{
+			desc:    "successful calls",
+			service: twirptest.NoopHatmaker(),
+		},
+		{
+			desc:    "failed calls",
+			service: twirptest.ErroringHatmaker(twirp.NotFoundError("not found")),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			tracer := setupMockTracer()
+			hooks := NewOpenTracingHooks(tracer, WithLifecyclePhases(LifecycleSpans))
+			server, client := serverAndClient(tt.service, hooks)
+
+			_, _ = client.MakeHat(context.Background(), &twirptest.Size{})
+			server.Close()
+
+			spans := tracer.FinishedSpans()
+			if !assert.Len(t, spans, 4, "expected three phase spans and the server span") {
+				return
+			}
+			serverSpan := spans[3]
+			assert.Equal(t, "MakeHat", serverSpan.OperationName)
+
+			phases := []string{RoutingPhase, HandlerPhase, ResponsePhase}
+			for i, phase := range phases {
+				assert.Equal(t, phase, spans[i].OperationName)
+				assert.Equal(t, serverSpan.SpanContext.SpanID, spans[i].ParentID, "expected %s to be a child of the server span", phase)
+				assert.False(t, spans[i].StartTime.Before(serverSpan.StartTime), "expected %s to start within the server span", phase)
+				if i > 0 {
+					assert.Equal(t, spans[i-1].FinishTime, spans[i].StartTime, "expected %s to start when %s ends", phase, phases[i-1])
+				}
+			}
+		})
+	}
+}
+
+func TestLifecycleLogs(t *testing.T) {
+	tracer := setupMockTracer()
+	hooks := NewOpenTracingHooks(tracer, WithLifecyclePhases(LifecycleLogs))
+	server, client := serverAndClient(twirptest.NoopHatmaker(), hooks)
+
+	_, err := client.MakeHat(context.Background(), &twirptest.Size{})
+	server.Close()
+	if err != nil {
+		t.Fatalf("twirptest client err=%q", err)
+	}
+
+	spans := tracer.FinishedSpans()
+	if !assert.Len(t, spans, 1, "expected only the server span") {
+		return
+	}
+
+	var events []string
+	for _, record := range spans[0].Logs() {
+		for _, field := range record.Fields {
+			if field.Key == "event" {
+				events = append(events, field.ValueString)
+			}
+		}
+	}
+	assert.Equal(t, []string{RequestRoutedEvent, ResponsePreparedEvent, ResponseSentEvent}, events)
+}
+
+func TestNoLifecyclePhases(t *testing.T) {
+	tracer := setupMockTracer()
+	hooks := NewOpenTracingHooks(tracer)
+	server, client := serverAndClient(twirptest.NoopHatmaker(), hooks)
+
+	_, _ = client.MakeHat(context.Background(), &twirptest.Size{})
+	server.Close()
+
+	spans := tracer.FinishedSpans()
+	if assert.Len(t, spans, 1, "expected only the server span") {
+		assert.Empty(t, spans[0].Logs(), "expected no logs")
+	}
+}
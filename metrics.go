@@ -0,0 +1,317 @@
+package ottwirp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/twitchtv/twirp"
+)
+
+// CallKind tells whether call metrics were recorded by a server or a client.
+type CallKind string
+
+const (
+	ServerCall CallKind = "server"
+	ClientCall CallKind = "client"
+)
+
+// CallMetrics describes a single completed Twirp call.
+type CallMetrics struct {
+	Kind    CallKind
+	Package string
+	Service string
+	Method  string
+
+	// ErrorCode is the Twirp error code of a failed call, and empty for a
+	// successful one.
+	ErrorCode twirp.ErrorCode
+
+	// Duration is the latency of the call. On the server it spans from the
+	// RequestReceived hook to the ResponseSent hook. On the client it spans
+	// until the response body is closed.
+	Duration time.Duration
+}
+
+// MetricsSink receives the metrics of every call seen by the server hooks,
+// the client hooks and TraceHTTPClient, whether or not the call is traced.
+type MetricsSink interface {
+	ObserveCall(call CallMetrics)
+}
+
+// WithMetrics defines a sink that receives call metrics.
+func WithMetrics(sink MetricsSink) TraceOption {
+	return func(opts *TraceOptions) {
+		opts.metrics = sink
+	}
+}
+
+func newCallMetrics(ctx context.Context, kind CallKind, start time.Time, errorCode twirp.ErrorCode) CallMetrics {
+	packageName, _ := twirp.PackageName(ctx)
+	serviceName, _ := twirp.ServiceName(ctx)
+	methodName, _ := twirp.MethodName(ctx)
+
+	return CallMetrics{
+		Kind:      kind,
+		Package:   packageName,
+		Service:   serviceName,
+		Method:    methodName,
+		ErrorCode: errorCode,
+		Duration:  time.Since(start),
+	}
+}
+
+// errorCodeFromStatus maps the status of a non-Twirp error response to a Twirp
+// error code, the same way Twirp clients do.
+func errorCodeFromStatus(status int) twirp.ErrorCode {
+	switch {
+	case status >= 300 && status < 400:
+		return twirp.Internal
+	case status == http.StatusBadRequest:
+		return twirp.Internal
+	case status == http.StatusUnauthorized:
+		return twirp.Unauthenticated
+	case status == http.StatusForbidden:
+		return twirp.PermissionDenied
+	case status == http.StatusNotFound:
+		return twirp.BadRoute
+	case status == http.StatusTooManyRequests,
+		status == http.StatusBadGateway,
+		status == http.StatusServiceUnavailable,
+		status == http.StatusGatewayTimeout:
+		return twirp.Unavailable
+	default:
+		return twirp.Unknown
+	}
+}
+
+// DefaultLatencyBuckets are the upper bounds, in seconds, of the latency
+// histogram buckets used by NewMetricsRegistry when none are given.
+var DefaultLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// MetricsRegistry is an in-process MetricsSink which keeps request counts,
+// error counts by Twirp error code and latency histograms per method, as well
+// as propagation error counts. It serves them over HTTP in the Prometheus text
+// exposition format:
+//
+//	twirp_requests_total{kind, package, service, method}
+//	twirp_errors_total{kind, package, service, method, code}
+//	twirp_request_duration_seconds{kind, package, service, method}
+//	twirp_propagation_errors_total{kind, operation}
+type MetricsRegistry struct {
+	buckets []float64
+
+	mu                sync.Mutex
+	series            map[methodKey]*methodSeries
+	propagationErrors map[propagationKey]uint64
+}
+
+var (
+	_ MetricsSink          = (*MetricsRegistry)(nil)
+	_ PropagationErrorSink = (*MetricsRegistry)(nil)
+	_ http.Handler         = (*MetricsRegistry)(nil)
+)
+
+type propagationKey struct {
+	kind      CallKind
+	operation string
+}
+
+type methodKey struct {
+	kind    CallKind
+	pkg     string
+	service string
+	method  string
+}
+
+type methodSeries struct {
+	requests     uint64
+	errors       map[twirp.ErrorCode]uint64
+	bucketCounts []uint64
+	sum          float64
+}
+
+// NewMetricsRegistry returns an empty MetricsRegistry whose latency histograms
+// use the given bucket upper bounds, in seconds, or DefaultLatencyBuckets.
+func NewMetricsRegistry(buckets ...float64) *MetricsRegistry {
+	if len(buckets) == 0 {
+		buckets = DefaultLatencyBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+
+	return &MetricsRegistry{
+		buckets:           buckets,
+		series:            make(map[methodKey]*methodSeries),
+		propagationErrors: make(map[propagationKey]uint64),
+	}
+}
+
+func (r *MetricsRegistry) ObserveCall(call CallMetrics) {
+	key := methodKey{kind: call.Kind, pkg: call.Package, service: call.Service, method: call.Method}
+	seconds := call.Duration.Seconds()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	series, ok := r.series[key]
+	if !ok {
+		series = &methodSeries{
+			errors:       make(map[twirp.ErrorCode]uint64),
+			bucketCounts: make([]uint64, len(r.buckets)),
+		}
+		r.series[key] = series
+	}
+
+	series.requests++
+	if call.ErrorCode != "" {
+		series.errors[call.ErrorCode]++
+	}
+	for i, bound := range r.buckets {
+		if seconds <= bound {
+			series.bucketCounts[i]++
+		}
+	}
+	series.sum += seconds
+}
+
+func (r *MetricsRegistry) ObservePropagationError(err *PropagationError) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.propagationErrors[propagationKey{kind: err.Kind, operation: err.Operation}]++
+}
+
+// Requests returns the number of calls observed for a method.
+func (r *MetricsRegistry) Requests(kind CallKind, packageName, serviceName, methodName string) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if series, ok := r.series[methodKey{kind, packageName, serviceName, methodName}]; ok {
+		return series.requests
+	}
+	return 0
+}
+
+// Errors returns the number of calls observed for a method which failed with
+// the given Twirp error code.
+func (r *MetricsRegistry) Errors(kind CallKind, packageName, serviceName, methodName string, code twirp.ErrorCode) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if series, ok := r.series[methodKey{kind, packageName, serviceName, methodName}]; ok {
+		return series.errors[code]
+	}
+	return 0
+}
+
+// PropagationErrors returns the number of span contexts that could not be
+// extracted or injected, by ExtractOperation or InjectOperation.
+func (r *MetricsRegistry) PropagationErrors(kind CallKind, operation string) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.propagationErrors[propagationKey{kind, operation}]
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (r *MetricsRegistry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_ = r.WriteText(w)
+}
+
+// WriteText writes the metrics in the Prometheus text exposition format.
+func (r *MetricsRegistry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	keys := make([]methodKey, 0, len(r.series))
+	for key := range r.series {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.kind != b.kind {
+			return a.kind < b.kind
+		}
+		if a.pkg != b.pkg {
+			return a.pkg < b.pkg
+		}
+		if a.service != b.service {
+			return a.service < b.service
+		}
+		return a.method < b.method
+	})
+
+	var b strings.Builder
+	b.WriteString("# HELP twirp_requests_total Total number of Twirp calls.\n")
+	b.WriteString("# TYPE twirp_requests_total counter\n")
+	for _, key := range keys {
+		fmt.Fprintf(&b, "twirp_requests_total{%s} %d\n", key.labels(), r.series[key].requests)
+	}
+
+	b.WriteString("# HELP twirp_errors_total Total number of failed Twirp calls by error code.\n")
+	b.WriteString("# TYPE twirp_errors_total counter\n")
+	for _, key := range keys {
+		errors := r.series[key].errors
+		codes := make([]string, 0, len(errors))
+		for code := range errors {
+			codes = append(codes, string(code))
+		}
+		sort.Strings(codes)
+		for _, code := range codes {
+			fmt.Fprintf(&b, "twirp_errors_total{%s,code=%s} %d\n", key.labels(), quoteLabel(code), errors[twirp.ErrorCode(code)])
+		}
+	}
+
+	b.WriteString("# HELP twirp_request_duration_seconds Latency of Twirp calls.\n")
+	b.WriteString("# TYPE twirp_request_duration_seconds histogram\n")
+	for _, key := range keys {
+		series := r.series[key]
+		for i, bound := range r.buckets {
+			le := strconv.FormatFloat(bound, 'g', -1, 64)
+			fmt.Fprintf(&b, "twirp_request_duration_seconds_bucket{%s,le=%s} %d\n", key.labels(), quoteLabel(le), series.bucketCounts[i])
+		}
+		fmt.Fprintf(&b, "twirp_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", key.labels(), series.requests)
+		fmt.Fprintf(&b, "twirp_request_duration_seconds_sum{%s} %s\n", key.labels(), strconv.FormatFloat(series.sum, 'g', -1, 64))
+		fmt.Fprintf(&b, "twirp_request_duration_seconds_count{%s} %d\n", key.labels(), series.requests)
+	}
+
+	propagationKeys := make([]propagationKey, 0, len(r.propagationErrors))
+	for key := range r.propagationErrors {
+		propagationKeys = append(propagationKeys, key)
+	}
+	sort.Slice(propagationKeys, func(i, j int) bool {
+		a, b := propagationKeys[i], propagationKeys[j]
+		if a.kind != b.kind {
+			return a.kind < b.kind
+		}
+		return a.operation < b.operation
+	})
+
+	b.WriteString("# HELP twirp_propagation_errors_total Total number of span contexts that could not be extracted or injected.\n")
+	b.WriteString("# TYPE twirp_propagation_errors_total counter\n")
+	for _, key := range propagationKeys {
+		fmt.Fprintf(&b, "twirp_propagation_errors_total{kind=%s,operation=%s} %d\n", quoteLabel(string(key.kind)), quoteLabel(key.operation), r.propagationErrors[key])
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (k methodKey) labels() string {
+	return fmt.Sprintf("kind=%s,package=%s,service=%s,method=%s",
+		quoteLabel(string(k.kind)), quoteLabel(k.pkg), quoteLabel(k.service), quoteLabel(k.method))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
@@ -0,0 +1,107 @@
+package ottwirp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/twirp-ecosystem/twirptest"
+	"github.com/twitchtv/twirp"
+)
+
+func TestMetrics(t *testing.T) {
+	tests := []struct {
+		desc      string
+		service   twirptest.Haberdasher
+		traceOpts []TraceOption
+		errorCode twirp.ErrorCode
+	}{
+		{
+			desc:    "successful calls are counted",
+			service: twirptest.NoopHatmaker(),
+		},
+		{
+			desc:      "failed calls are counted by error code",
+			service:   twirptest.ErroringHatmaker(twirp.NotFoundError("not found")),
+			errorCode: twirp.NotFound,
+		},
+		{
+			desc:      "non-twirp errors are counted as internal errors",
+			service:   twirptest.ErroringHatmaker(errors.New("test")),
+			errorCode: twirp.Internal,
+		},
+		{
+			desc:      "filtered calls are counted",
+			service:   twirptest.ErroringHatmaker(twirp.NotFoundError("not found")),
+			traceOpts: []TraceOption{DenyMethods(MethodRule{})},
+			errorCode: twirp.NotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			tracer := setupMockTracer()
+			registry := NewMetricsRegistry()
+			opts := append([]TraceOption{WithMetrics(registry)}, tt.traceOpts...)
+			hooks := NewOpenTracingHooks(tracer, opts...)
+			server, client := TraceServerAndTraceClient(tt.service, hooks, tracer, opts...)
+
+			_, _ = client.MakeHat(context.Background(), &twirptest.Size{})
+			server.Close()
+
+			for _, kind := range []CallKind{ServerCall, ClientCall} {
+				assert.Equal(t, uint64(1), registry.Requests(kind, "twirptest", "Haberdasher", "MakeHat"), "expected a %s request", kind)
+				if tt.errorCode != "" {
+					assert.Equal(t, uint64(1), registry.Errors(kind, "twirptest", "Haberdasher", "MakeHat", tt.errorCode), "expected a %s error", kind)
+				}
+			}
+		})
+	}
+}
+
+func TestClientHooksMetrics(t *testing.T) {
+	tracer := setupMockTracer()
+	registry := NewMetricsRegistry()
+	hooks := NewOpenTracingHooks(tracer)
+	server := httptest.NewServer(WithTraceContext(twirptest.NewHaberdasherServer(twirptest.ErroringHatmaker(twirp.NotFoundError("not found")), hooks), tracer))
+	defer server.Close()
+	// The TraceHTTPClient's own sink must not count calls seen by the hooks.
+	httpClient := NewTraceHTTPClient(http.DefaultClient, tracer, WithMetrics(registry))
+	client := hookedHaberdasherClient(server.URL, httpClient, NewOpenTracingClientHooks(tracer, WithMetrics(registry)))
+
+	_, _ = client.MakeHat(context.Background(), &twirptest.Size{})
+
+	assert.Equal(t, uint64(1), registry.Requests(ClientCall, "twirptest", "Haberdasher", "MakeHat"), "expected a single client request")
+	assert.Equal(t, uint64(1), registry.Errors(ClientCall, "twirptest", "Haberdasher", "MakeHat", twirp.NotFound), "expected a not_found error")
+}
+
+func TestMetricsRegistryWriteText(t *testing.T) {
+	registry := NewMetricsRegistry(0.1, 1)
+	registry.ObserveCall(CallMetrics{Kind: ServerCall, Package: "twirptest", Service: "Haberdasher", Method: "MakeHat", Duration: 50 * time.Millisecond})
+	registry.ObserveCall(CallMetrics{Kind: ServerCall, Package: "twirptest", Service: "Haberdasher", Method: "MakeHat", ErrorCode: twirp.NotFound, Duration: 500 * time.Millisecond})
+	registry.ObservePropagationError(&PropagationError{Kind: ServerCall, Operation: ExtractOperation})
+
+	rec := httptest.NewRecorder()
+	registry.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	labels := `kind="server",package="twirptest",service="Haberdasher",method="MakeHat"`
+	expected := []string{
+		`twirp_requests_total{` + labels + `} 2`,
+		`twirp_errors_total{` + labels + `,code="not_found"} 1`,
+		`twirp_request_duration_seconds_bucket{` + labels + `,le="0.1"} 1`,
+		`twirp_request_duration_seconds_bucket{` + labels + `,le="1"} 2`,
+		`twirp_request_duration_seconds_bucket{` + labels + `,le="+Inf"} 2`,
+		`twirp_request_duration_seconds_sum{` + labels + `} 0.55`,
+		`twirp_request_duration_seconds_count{` + labels + `} 2`,
+		`twirp_propagation_errors_total{kind="server",operation="extract"} 1`,
+	}
+	lines := strings.Split(rec.Body.String(), "\n")
+	for _, line := range expected {
+		assert.Contains(t, lines, line)
+	}
+}
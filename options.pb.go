@@ -0,0 +1,199 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.5
+// 	protoc        (unknown)
+// source: ottwirp/options.proto
+
+package ottwirp
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	descriptorpb "google.golang.org/protobuf/types/descriptorpb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// MethodOptions configures the tracing of a method.
+type MethodOptions struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// skip disables tracing of the method.
+	Skip bool `protobuf:"varint,1,opt,name=skip,proto3" json:"skip,omitempty"`
+	// sample_rate traces the method with the given probability, between 0 and 1.
+	SampleRate    *float64 `protobuf:"fixed64,2,opt,name=sample_rate,json=sampleRate,proto3,oneof" json:"sample_rate,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *MethodOptions) Reset() {
+	*x = MethodOptions{}
+	mi := &file_ottwirp_options_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *MethodOptions) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MethodOptions) ProtoMessage() {}
+
+func (x *MethodOptions) ProtoReflect() protoreflect.Message {
+	mi := &file_ottwirp_options_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MethodOptions.ProtoReflect.Descriptor instead.
+func (*MethodOptions) Descriptor() ([]byte, []int) {
+	return file_ottwirp_options_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *MethodOptions) GetSkip() bool {
+	if x != nil {
+		return x.Skip
+	}
+	return false
+}
+
+func (x *MethodOptions) GetSampleRate() float64 {
+	if x != nil && x.SampleRate != nil {
+		return *x.SampleRate
+	}
+	return 0
+}
+
+var file_ottwirp_options_proto_extTypes = []protoimpl.ExtensionInfo{
+	{
+		ExtendedType:  (*descriptorpb.FieldOptions)(nil),
+		ExtensionType: (*string)(nil),
+		Field:         51700,
+		Name:          "ottwirp.tag",
+		Tag:           "bytes,51700,opt,name=tag",
+		Filename:      "ottwirp/options.proto",
+	},
+	{
+		ExtendedType:  (*descriptorpb.MethodOptions)(nil),
+		ExtensionType: (*MethodOptions)(nil),
+		Field:         51700,
+		Name:          "ottwirp.method",
+		Tag:           "bytes,51700,opt,name=method",
+		Filename:      "ottwirp/options.proto",
+	},
+}
+
+// Extension fields to descriptorpb.FieldOptions.
+var (
+	// tag sets the value of a request field as a span tag with the given name,
+	// such as (ottwirp.tag) = "user.id". It is supported on singular scalar,
+	// string and enum fields of request messages and their nested messages.
+	//
+	// optional string tag = 51700;
+	E_Tag = &file_ottwirp_options_proto_extTypes[0]
+)
+
+// Extension fields to descriptorpb.MethodOptions.
+var (
+	// method configures the tracing of the method, such as
+	// option (ottwirp.method).sample_rate = 0.5.
+	//
+	// optional ottwirp.MethodOptions method = 51700;
+	E_Method = &file_ottwirp_options_proto_extTypes[1]
+)
+
+var File_ottwirp_options_proto protoreflect.FileDescriptor
+
+var file_ottwirp_options_proto_rawDesc = string([]byte{
+	0x0a, 0x15, 0x6f, 0x74, 0x74, 0x77, 0x69, 0x72, 0x70, 0x2f, 0x6f, 0x70, 0x74, 0x69, 0x6f, 0x6e,
+	0x73, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x07, 0x6f, 0x74, 0x74, 0x77, 0x69, 0x72, 0x70,
+	0x1a, 0x20, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75,
+	0x66, 0x2f, 0x64, 0x65, 0x73, 0x63, 0x72, 0x69, 0x70, 0x74, 0x6f, 0x72, 0x2e, 0x70, 0x72, 0x6f,
+	0x74, 0x6f, 0x22, 0x59, 0x0a, 0x0d, 0x4d, 0x65, 0x74, 0x68, 0x6f, 0x64, 0x4f, 0x70, 0x74, 0x69,
+	0x6f, 0x6e, 0x73, 0x12, 0x12, 0x0a, 0x04, 0x73, 0x6b, 0x69, 0x70, 0x18, 0x01, 0x20, 0x01, 0x28,
+	0x08, 0x52, 0x04, 0x73, 0x6b, 0x69, 0x70, 0x12, 0x24, 0x0a, 0x0b, 0x73, 0x61, 0x6d, 0x70, 0x6c,
+	0x65, 0x5f, 0x72, 0x61, 0x74, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x01, 0x48, 0x00, 0x52, 0x0a,
+	0x73, 0x61, 0x6d, 0x70, 0x6c, 0x65, 0x52, 0x61, 0x74, 0x65, 0x88, 0x01, 0x01, 0x42, 0x0e, 0x0a,
+	0x0c, 0x5f, 0x73, 0x61, 0x6d, 0x70, 0x6c, 0x65, 0x5f, 0x72, 0x61, 0x74, 0x65, 0x3a, 0x31, 0x0a,
+	0x03, 0x74, 0x61, 0x67, 0x12, 0x1d, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72,
+	0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x46, 0x69, 0x65, 0x6c, 0x64, 0x4f, 0x70, 0x74, 0x69,
+	0x6f, 0x6e, 0x73, 0x18, 0xf4, 0x93, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x74, 0x61, 0x67,
+	0x3a, 0x50, 0x0a, 0x06, 0x6d, 0x65, 0x74, 0x68, 0x6f, 0x64, 0x12, 0x1e, 0x2e, 0x67, 0x6f, 0x6f,
+	0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x4d, 0x65, 0x74,
+	0x68, 0x6f, 0x64, 0x4f, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x18, 0xf4, 0x93, 0x03, 0x20, 0x01,
+	0x28, 0x0b, 0x32, 0x16, 0x2e, 0x6f, 0x74, 0x74, 0x77, 0x69, 0x72, 0x70, 0x2e, 0x4d, 0x65, 0x74,
+	0x68, 0x6f, 0x64, 0x4f, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x52, 0x06, 0x6d, 0x65, 0x74, 0x68,
+	0x6f, 0x64, 0x42, 0x36, 0x5a, 0x34, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d,
+	0x2f, 0x74, 0x77, 0x69, 0x72, 0x70, 0x2d, 0x65, 0x63, 0x6f, 0x73, 0x79, 0x73, 0x74, 0x65, 0x6d,
+	0x2f, 0x74, 0x77, 0x69, 0x72, 0x70, 0x2d, 0x6f, 0x70, 0x65, 0x6e, 0x74, 0x72, 0x61, 0x63, 0x69,
+	0x6e, 0x67, 0x3b, 0x6f, 0x74, 0x74, 0x77, 0x69, 0x72, 0x70, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74,
+	0x6f, 0x33,
+})
+
+var (
+	file_ottwirp_options_proto_rawDescOnce sync.Once
+	file_ottwirp_options_proto_rawDescData []byte
+)
+
+func file_ottwirp_options_proto_rawDescGZIP() []byte {
+	file_ottwirp_options_proto_rawDescOnce.Do(func() {
+		file_ottwirp_options_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_ottwirp_options_proto_rawDesc), len(file_ottwirp_options_proto_rawDesc)))
+	})
+	return file_ottwirp_options_proto_rawDescData
+}
+
+var file_ottwirp_options_proto_msgTypes = make([]protoimpl.MessageInfo, 1)
+var file_ottwirp_options_proto_goTypes = []any{
+	(*MethodOptions)(nil),              // 0: ottwirp.MethodOptions
+	(*descriptorpb.FieldOptions)(nil),  // 1: google.protobuf.FieldOptions
+	(*descriptorpb.MethodOptions)(nil), // 2: google.protobuf.MethodOptions
+}
+var file_ottwirp_options_proto_depIdxs = []int32{
+	1, // 0: ottwirp.tag:extendee -> google.protobuf.FieldOptions
+	2, // 1: ottwirp.method:extendee -> google.protobuf.MethodOptions
+	0, // 2: ottwirp.method:type_name -> ottwirp.MethodOptions
+	3, // [3:3] is the sub-list for method output_type
+	3, // [3:3] is the sub-list for method input_type
+	2, // [2:3] is the sub-list for extension type_name
+	0, // [0:2] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_ottwirp_options_proto_init() }
+func file_ottwirp_options_proto_init() {
+	if File_ottwirp_options_proto != nil {
+		return
+	}
+	file_ottwirp_options_proto_msgTypes[0].OneofWrappers = []any{}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_ottwirp_options_proto_rawDesc), len(file_ottwirp_options_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   1,
+			NumExtensions: 2,
+			NumServices:   0,
+		},
+		GoTypes:           file_ottwirp_options_proto_goTypes,
+		DependencyIndexes: file_ottwirp_options_proto_depIdxs,
+		MessageInfos:      file_ottwirp_options_proto_msgTypes,
+		ExtensionInfos:    file_ottwirp_options_proto_extTypes,
+	}.Build()
+	File_ottwirp_options_proto = out.File
+	file_ottwirp_options_proto_goTypes = nil
+	file_ottwirp_options_proto_depIdxs = nil
+}
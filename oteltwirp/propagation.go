@@ -0,0 +1,54 @@
+package oteltwirp
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// WithPropagators defines several propagators used together, so a trace stays
+// connected while callers migrate from one propagation format to another, for
+// example from Jaeger or B3 headers to W3C trace context.
+//
+// The order of the propagators sets their precedence: when an incoming request
+// carries span contexts in several formats, the one extracted by the earliest
+// propagator wins. Outgoing requests carry the headers of every propagator.
+func WithPropagators(propagators ...propagation.TextMapPropagator) TraceOption {
+	return WithPropagator(precedencePropagator(propagators))
+}
+
+// precedencePropagator is a composite propagator in which earlier propagators
+// take precedence over later ones on extraction.
+type precedencePropagator []propagation.TextMapPropagator
+
+var _ propagation.TextMapPropagator = precedencePropagator(nil)
+
+func (p precedencePropagator) Inject(ctx context.Context, carrier propagation.TextMapCarrier) {
+	for _, propagator := range p {
+		propagator.Inject(ctx, carrier)
+	}
+}
+
+func (p precedencePropagator) Extract(ctx context.Context, carrier propagation.TextMapCarrier) context.Context {
+	// Propagators leave the context untouched when they find nothing, so
+	// extracting with the lowest precedence first lets the propagators with a
+	// higher precedence override it.
+	for i := len(p) - 1; i >= 0; i-- {
+		ctx = p[i].Extract(ctx, carrier)
+	}
+	return ctx
+}
+
+func (p precedencePropagator) Fields() []string {
+	seen := make(map[string]bool)
+	var fields []string
+	for _, propagator := range p {
+		for _, field := range propagator.Fields() {
+			if !seen[field] {
+				seen[field] = true
+				fields = append(fields, field)
+			}
+		}
+	}
+	return fields
+}
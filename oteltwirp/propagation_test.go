@@ -0,0 +1,107 @@
+package oteltwirp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	ottwirp "github.com/twirp-ecosystem/twirp-opentracing"
+	"github.com/twirp-ecosystem/twirptest"
+	"go.opentelemetry.io/contrib/propagators/jaeger"
+	otelbridge "go.opentelemetry.io/otel/bridge/opentracing"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestWithPropagatorsConnectsOpenTracingCallers(t *testing.T) {
+	exporter, tp := setupTracerProvider()
+	hooks := NewOpenTelemetryHooks(tp)
+	server := httptest.NewServer(WithTraceContext(
+		twirptest.NewHaberdasherServer(twirptest.NoopHatmaker(), hooks),
+		WithPropagators(propagation.TraceContext{}, jaeger.Jaeger{}),
+	))
+	defer server.Close()
+
+	// An OpenTracing caller propagating uber-trace-id headers.
+	bridgeTracer, _ := otelbridge.NewTracerPair(tp.Tracer("bridge"))
+	bridgeTracer.SetTextMapPropagator(jaeger.Jaeger{})
+	client := twirptest.NewHaberdasherProtobufClient(server.URL, ottwirp.NewTraceHTTPClient(http.DefaultClient, bridgeTracer))
+
+	_, err := client.MakeHat(context.Background(), &twirptest.Size{})
+	if err != nil {
+		t.Fatalf("twirptest client err=%q", err)
+	}
+
+	spans := exporter.GetSpans()
+	if !assert.Len(t, spans, 2, "expected server and client spans") {
+		return
+	}
+	serverSpan, clientSpan := spans[0], spans[1]
+	assert.Equal(t, clientSpan.SpanContext.TraceID(), serverSpan.SpanContext.TraceID(), "expected trace to propagate properly")
+	assert.Equal(t, clientSpan.SpanContext.SpanID(), serverSpan.Parent.SpanID(), "expected span to propagate properly")
+}
+
+func TestWithPropagatorsPrecedence(t *testing.T) {
+	_, tp := setupTracerProvider()
+	_, w3cParent := tp.Tracer("test").Start(context.Background(), "w3c")
+	_, jaegerParent := tp.Tracer("test").Start(context.Background(), "jaeger")
+
+	header := http.Header{}
+	propagation.TraceContext{}.Inject(trace.ContextWithSpan(context.Background(), w3cParent), propagation.HeaderCarrier(header))
+	jaeger.Jaeger{}.Inject(trace.ContextWithSpan(context.Background(), jaegerParent), propagation.HeaderCarrier(header))
+
+	tests := []struct {
+		desc        string
+		propagators []propagation.TextMapPropagator
+		expected    trace.Span
+	}{
+		{
+			desc:        "W3C trace context takes precedence",
+			propagators: []propagation.TextMapPropagator{propagation.TraceContext{}, jaeger.Jaeger{}},
+			expected:    w3cParent,
+		},
+		{
+			desc:        "Jaeger takes precedence",
+			propagators: []propagation.TextMapPropagator{jaeger.Jaeger{}, propagation.TraceContext{}},
+			expected:    jaegerParent,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			var extracted trace.SpanContext
+			handler := WithTraceContext(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				extracted = trace.SpanContextFromContext(r.Context())
+			}), WithPropagators(tt.propagators...))
+
+			req := httptest.NewRequest("POST", "/", nil)
+			req.Header = header
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			assert.Equal(t, tt.expected.SpanContext().TraceID(), extracted.TraceID(), "expected trace to match")
+			assert.Equal(t, tt.expected.SpanContext().SpanID(), extracted.SpanID(), "expected span to match")
+		})
+	}
+}
+
+func TestWithPropagatorsInjectsEveryFormat(t *testing.T) {
+	_, tp := setupTracerProvider()
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+	}))
+	defer server.Close()
+
+	client := NewTraceHTTPClient(http.DefaultClient, tp, WithPropagators(propagation.TraceContext{}, jaeger.Jaeger{}))
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("http client err=%q", err)
+	}
+	res.Body.Close()
+
+	assert.NotEmpty(t, header.Get("traceparent"), "expected a W3C traceparent header")
+	assert.NotEmpty(t, header.Get("uber-trace-id"), "expected a Jaeger uber-trace-id header")
+}
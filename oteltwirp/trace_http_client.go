@@ -0,0 +1,98 @@
+package oteltwirp
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/twitchtv/twirp"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// HTTPClient as an interface that models *http.Client.
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// TraceHTTPClient wraps a provided http.Client and tracer for instrumenting
+// requests.
+type TraceHTTPClient struct {
+	client HTTPClient
+	tracer trace.Tracer
+	opts   *TraceOptions
+}
+
+var _ HTTPClient = (*TraceHTTPClient)(nil)
+
+func NewTraceHTTPClient(client HTTPClient, tp trace.TracerProvider, opts ...TraceOption) *TraceHTTPClient {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &TraceHTTPClient{
+		client: client,
+		tracer: tp.Tracer(InstrumentationName),
+		opts:   newTraceOptions(opts),
+	}
+}
+
+// Do starts a client span, injects its context into the request headers and
+// makes the actual request. The span ends when the response body is closed.
+func (c *TraceHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	spanName := req.URL.Path
+	if _, ok := twirp.MethodName(ctx); ok {
+		spanName = fullMethodName(ctx)
+	}
+	ctx, span := c.tracer.Start(ctx, spanName,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(rpcAttributes(ctx)...),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(req.Method),
+			semconv.URLFull(req.URL.String()),
+		),
+		trace.WithAttributes(c.opts.attributes...),
+	)
+	if c.opts.ctxAttributesFn != nil {
+		span.SetAttributes(c.opts.ctxAttributesFn(ctx)...)
+	}
+
+	req = req.WithContext(ctx)
+	c.opts.propagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		return res, err
+	}
+	span.SetAttributes(semconv.HTTPResponseStatusCode(res.StatusCode))
+
+	// Check for error codes greater than 400 if includeClientErrors is set and
+	// codes greater than 500 if not, and mark the span as an error if appropriate.
+	if res.StatusCode >= 400 && c.opts.includeClientErrors || res.StatusCode >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(res.StatusCode))
+	}
+
+	// We want to track when the body is closed, meaning the server is done with
+	// the response.
+	res.Body = closer{
+		ReadCloser: res.Body,
+		span:       span,
+	}
+	return res, nil
+}
+
+type closer struct {
+	io.ReadCloser
+	span trace.Span
+}
+
+func (c closer) Close() error {
+	err := c.ReadCloser.Close()
+	c.span.End()
+	return err
+}
@@ -0,0 +1,130 @@
+package oteltwirp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/twirp-ecosystem/twirptest"
+	"github.com/twitchtv/twirp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTraceHTTPClient(t *testing.T) {
+	tests := []struct {
+		desc               string
+		errExpected        bool
+		service            twirptest.Haberdasher
+		clientOpts         []TraceOption
+		expectedAttributes func(*httptest.Server) []attribute.KeyValue
+		expectedStatus     sdktrace.Status
+	}{
+		{
+			desc:        "properly traces valid requests",
+			errExpected: false,
+			service:     twirptest.NoopHatmaker(),
+			expectedAttributes: func(server *httptest.Server) []attribute.KeyValue {
+				return []attribute.KeyValue{
+					attribute.String("rpc.system", "twirp"),
+					attribute.String("rpc.service", "twirptest.Haberdasher"),
+					attribute.String("rpc.method", "MakeHat"),
+					attribute.String("http.request.method", "POST"),
+					attribute.String("url.full", fmt.Sprintf("%s/twirp/twirptest.Haberdasher/MakeHat", server.URL)),
+					attribute.Int("http.response.status_code", 200),
+				}
+			},
+		},
+		{
+			desc:        "properly sets status for errors",
+			errExpected: true,
+			service:     twirptest.ErroringHatmaker(errors.New("test")),
+			expectedAttributes: func(server *httptest.Server) []attribute.KeyValue {
+				return []attribute.KeyValue{
+					attribute.String("rpc.system", "twirp"),
+					attribute.String("rpc.service", "twirptest.Haberdasher"),
+					attribute.String("rpc.method", "MakeHat"),
+					attribute.String("http.request.method", "POST"),
+					attribute.String("url.full", fmt.Sprintf("%s/twirp/twirptest.Haberdasher/MakeHat", server.URL)),
+					attribute.Int("http.response.status_code", 500),
+				}
+			},
+			expectedStatus: sdktrace.Status{Code: codes.Error, Description: "Internal Server Error"},
+		},
+		{
+			desc:        "does not report client errors in span if correct option is set",
+			errExpected: true,
+			service:     twirptest.ErroringHatmaker(twirp.NotFoundError("not found")),
+			clientOpts:  []TraceOption{IncludeClientErrors(false)},
+			expectedAttributes: func(server *httptest.Server) []attribute.KeyValue {
+				return []attribute.KeyValue{
+					attribute.String("rpc.system", "twirp"),
+					attribute.String("rpc.service", "twirptest.Haberdasher"),
+					attribute.String("rpc.method", "MakeHat"),
+					attribute.String("http.request.method", "POST"),
+					attribute.String("url.full", fmt.Sprintf("%s/twirp/twirptest.Haberdasher/MakeHat", server.URL)),
+					attribute.Int("http.response.status_code", 404),
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			exporter, tp := setupTracerProvider()
+			hooks := NewOpenTelemetryHooks(tp)
+			server, client := TraceServerAndTraceClient(tt.service, hooks, tp, tt.clientOpts...)
+			defer server.Close()
+
+			_, err := client.MakeHat(context.Background(), &twirptest.Size{})
+			if err != nil {
+				if !tt.errExpected {
+					t.Fatalf("twirptest client err=%q", err)
+				} else {
+					assert.Error(t, err, "expected an error")
+				}
+			}
+			spans := exporter.GetSpans()
+			if !assert.Len(t, spans, 2, "expected server and client spans") {
+				return
+			}
+			serverSpan, clientSpan := spans[0], spans[1]
+			assert.Equal(t, "twirptest.Haberdasher/MakeHat", clientSpan.Name, "expected span name to be the full method name")
+			assert.Equal(t, trace.SpanKindClient, clientSpan.SpanKind)
+			assert.Equal(t, tt.expectedAttributes(server), clientSpan.Attributes, "expected attributes to match")
+			assert.Equal(t, tt.expectedStatus, clientSpan.Status, "expected status to match")
+			assert.Equal(t, serverSpan.SpanContext.TraceID(), clientSpan.SpanContext.TraceID(), "expected trace to propagate properly")
+			assert.Equal(t, serverSpan.Parent.SpanID(), clientSpan.SpanContext.SpanID(), "expected span to propagate properly")
+		})
+	}
+}
+
+func TestTraceHTTPClientInjectsTraceparent(t *testing.T) {
+	_, tp := setupTracerProvider()
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+	}))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	res, err := NewTraceHTTPClient(http.DefaultClient, tp).Do(req)
+	if err != nil {
+		t.Fatalf("http client err=%q", err)
+	}
+	res.Body.Close()
+
+	assert.Regexp(t, "^00-[0-9a-f]{32}-[0-9a-f]{16}-01$", header.Get("traceparent"), "expected a W3C traceparent header")
+}
+
+func TraceServerAndTraceClient(h twirptest.Haberdasher, hooks *twirp.ServerHooks, tp trace.TracerProvider, opts ...TraceOption) (*httptest.Server, twirptest.Haberdasher) {
+	s := httptest.NewServer(WithTraceContext(twirptest.NewHaberdasherServer(h, hooks)))
+	c := twirptest.NewHaberdasherProtobufClient(s.URL, NewTraceHTTPClient(http.DefaultClient, tp, opts...))
+	return s, c
+}
@@ -0,0 +1,207 @@
+// Package oteltwirp records OpenTelemetry spans for Twirp servers and clients.
+// It mirrors the ottwirp package for services that have moved from
+// OpenTracing to OpenTelemetry: spans follow the RPC semantic conventions and
+// span contexts are propagated with W3C trace context headers by default.
+package oteltwirp
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/twitchtv/twirp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// RequestReceivedEvent is the name of a server span until its request has
+	// been routed to a method.
+	RequestReceivedEvent = "request.received"
+
+	// InstrumentationName is the name of the tracers used by this package.
+	InstrumentationName = "github.com/twirp-ecosystem/twirp-opentracing/oteltwirp"
+)
+
+// rpcSystem identifies Twirp as the RPC system of a span.
+var rpcSystem = semconv.RPCSystemKey.String("twirp")
+
+type TraceServerHooks struct {
+	Tracer trace.Tracer
+	opts   *TraceOptions
+}
+
+type TraceOptions struct {
+	includeClientErrors bool
+	propagator          propagation.TextMapPropagator
+	attributes          []attribute.KeyValue
+	ctxAttributesFn     func(ctx context.Context) []attribute.KeyValue
+}
+
+type TraceOption func(opts *TraceOptions)
+
+// IncludeClientErrors, if set, will report client errors (4xx) as errors in the span status.
+// If not set, only 5xx status will be reported as erroneous.
+func IncludeClientErrors(includeClientErrors bool) TraceOption {
+	return func(opts *TraceOptions) {
+		opts.includeClientErrors = includeClientErrors
+	}
+}
+
+// WithPropagator defines the propagator used to extract and inject span
+// contexts. It defaults to W3C trace context.
+func WithPropagator(propagator propagation.TextMapPropagator) TraceOption {
+	return func(opts *TraceOptions) {
+		opts.propagator = propagator
+	}
+}
+
+// WithAttributes defines attributes to be added to each span by default.
+// Calling WithAttributes multiple times adds to the attributes.
+func WithAttributes(attributes ...attribute.KeyValue) TraceOption {
+	return func(opts *TraceOptions) {
+		opts.attributes = append(opts.attributes, attributes...)
+	}
+}
+
+// WithContextAttributes defines a function that returns a set of attributes
+// from the request ctx to be added to the span when it is started.
+func WithContextAttributes(fn func(ctx context.Context) []attribute.KeyValue) TraceOption {
+	return func(opts *TraceOptions) {
+		opts.ctxAttributesFn = fn
+	}
+}
+
+func newTraceOptions(opts []TraceOption) *TraceOptions {
+	traceOpts := &TraceOptions{
+		includeClientErrors: true,
+		propagator:          propagation.TraceContext{},
+	}
+
+	for _, opt := range opts {
+		opt(traceOpts)
+	}
+
+	return traceOpts
+}
+
+// NewOpenTelemetryHooks provides a twirp.ServerHooks struct which records
+// OpenTelemetry spans. The server must be wrapped with WithTraceContext for
+// spans to continue the trace of the caller.
+func NewOpenTelemetryHooks(tp trace.TracerProvider, opts ...TraceOption) *twirp.ServerHooks {
+	traceHooks := &TraceServerHooks{
+		Tracer: tp.Tracer(InstrumentationName),
+		opts:   newTraceOptions(opts),
+	}
+
+	return traceHooks.TwirpHooks()
+}
+
+func (t *TraceServerHooks) TwirpHooks() *twirp.ServerHooks {
+	return &twirp.ServerHooks{
+		RequestReceived: t.startTraceSpan,
+		RequestRouted:   t.handleRequestRouted,
+		ResponseSent:    t.finishTrace,
+		Error:           t.handleError,
+	}
+}
+
+func (t *TraceServerHooks) startTraceSpan(ctx context.Context) (context.Context, error) {
+	// Create the initial span, it won't have a method name just yet.
+	ctx, span := t.Tracer.Start(ctx, RequestReceivedEvent,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(rpcAttributes(ctx)...),
+		trace.WithAttributes(t.opts.attributes...),
+	)
+	if t.opts.ctxAttributesFn != nil {
+		span.SetAttributes(t.opts.ctxAttributesFn(ctx)...)
+	}
+
+	return ctx, nil
+}
+
+// handleRequestRouted sets the span name because we won't know what it is
+// until the RequestRouted hook.
+func (t *TraceServerHooks) handleRequestRouted(ctx context.Context) (context.Context, error) {
+	span := trace.SpanFromContext(ctx)
+	if method, ok := twirp.MethodName(ctx); ok {
+		span.SetName(fullMethodName(ctx))
+		span.SetAttributes(semconv.RPCMethod(method))
+	}
+
+	return ctx, nil
+}
+
+func (t *TraceServerHooks) finishTrace(ctx context.Context) {
+	span := trace.SpanFromContext(ctx)
+	if status, ok := twirp.StatusCode(ctx); ok {
+		if code, err := strconv.Atoi(status); err == nil {
+			span.SetAttributes(semconv.HTTPResponseStatusCode(code))
+		}
+	}
+
+	span.End()
+}
+
+func (t *TraceServerHooks) handleError(ctx context.Context, err twirp.Error) context.Context {
+	setTwirpErrorSpan(trace.SpanFromContext(ctx), err, t.opts)
+	return ctx
+}
+
+// setTwirpErrorSpan records err on the span and sets the span status to error
+// unless err is a client error that should not be reported.
+func setTwirpErrorSpan(span trace.Span, err twirp.Error, opts *TraceOptions) {
+	span.SetAttributes(attribute.String("twirp.error_code", string(err.Code())))
+	span.RecordError(err)
+
+	statusCode := twirp.ServerHTTPStatusFromErrorCode(err.Code())
+	if opts.includeClientErrors || statusCode >= 500 {
+		span.SetStatus(codes.Error, err.Msg())
+	}
+}
+
+// WithTraceContext wraps the handler and extracts the span context from request
+// headers to attach to the context for connecting client and server calls.
+func WithTraceContext(base http.Handler, opts ...TraceOption) http.Handler {
+	traceOpts := newTraceOptions(opts)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := traceOpts.propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		r = r.WithContext(ctx)
+
+		base.ServeHTTP(w, r)
+	})
+}
+
+// rpcAttributes returns the RPC semantic convention attributes for the call in
+// ctx.
+func rpcAttributes(ctx context.Context) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{rpcSystem}
+	if service := fullServiceName(ctx); service != "" {
+		attrs = append(attrs, semconv.RPCService(service))
+	}
+	if method, ok := twirp.MethodName(ctx); ok {
+		attrs = append(attrs, semconv.RPCMethod(method))
+	}
+	return attrs
+}
+
+// fullServiceName returns the package qualified service name of the call in
+// ctx, as in "twirptest.Haberdasher".
+func fullServiceName(ctx context.Context) string {
+	serviceName, _ := twirp.ServiceName(ctx)
+	if packageName, ok := twirp.PackageName(ctx); ok && packageName != "" {
+		return packageName + "." + serviceName
+	}
+	return serviceName
+}
+
+// fullMethodName returns the span name of the call in ctx, as in
+// "twirptest.Haberdasher/MakeHat".
+func fullMethodName(ctx context.Context) string {
+	methodName, _ := twirp.MethodName(ctx)
+	return fullServiceName(ctx) + "/" + methodName
+}
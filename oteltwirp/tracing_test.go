@@ -0,0 +1,142 @@
+package oteltwirp
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/twirp-ecosystem/twirptest"
+	"github.com/twitchtv/twirp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracingHooks(t *testing.T) {
+	tests := []struct {
+		desc               string
+		service            twirptest.Haberdasher
+		traceOpts          []TraceOption
+		expectedAttributes []attribute.KeyValue
+		expectedStatus     sdktrace.Status
+		expectedEvents     int
+		errExpected        bool
+	}{
+		{
+			desc:    "sets attributes with span name for a valid request",
+			service: twirptest.NoopHatmaker(),
+			expectedAttributes: []attribute.KeyValue{
+				attribute.String("rpc.system", "twirp"),
+				attribute.String("rpc.service", "twirptest.Haberdasher"),
+				attribute.String("rpc.method", "MakeHat"),
+				attribute.Int("http.response.status_code", 200),
+			},
+		},
+		{
+			desc:    "sets additional and context attributes",
+			service: twirptest.NoopHatmaker(),
+			traceOpts: []TraceOption{
+				WithAttributes(attribute.String("foo", "bar")),
+				WithContextAttributes(func(ctx context.Context) []attribute.KeyValue {
+					return []attribute.KeyValue{attribute.String("city", "tokyo")}
+				}),
+			},
+			expectedAttributes: []attribute.KeyValue{
+				attribute.String("rpc.system", "twirp"),
+				attribute.String("rpc.service", "twirptest.Haberdasher"),
+				attribute.String("foo", "bar"),
+				attribute.String("city", "tokyo"),
+				attribute.String("rpc.method", "MakeHat"),
+				attribute.Int("http.response.status_code", 200),
+			},
+		},
+		{
+			desc:    "sets error status and code for an errored request",
+			service: twirptest.ErroringHatmaker(errors.New("test")),
+			expectedAttributes: []attribute.KeyValue{
+				attribute.String("rpc.system", "twirp"),
+				attribute.String("rpc.service", "twirptest.Haberdasher"),
+				attribute.String("rpc.method", "MakeHat"),
+				attribute.String("twirp.error_code", "internal"),
+				attribute.Int("http.response.status_code", 500),
+			},
+			expectedStatus: sdktrace.Status{Code: codes.Error, Description: "test"},
+			expectedEvents: 1,
+			errExpected:    true,
+		},
+		{
+			desc:      "user error should not be reported as an error status when correct option is set",
+			service:   twirptest.ErroringHatmaker(twirp.NotFoundError("not found")),
+			traceOpts: []TraceOption{IncludeClientErrors(false)},
+			expectedAttributes: []attribute.KeyValue{
+				attribute.String("rpc.system", "twirp"),
+				attribute.String("rpc.service", "twirptest.Haberdasher"),
+				attribute.String("rpc.method", "MakeHat"),
+				attribute.String("twirp.error_code", "not_found"),
+				attribute.Int("http.response.status_code", 404),
+			},
+			expectedEvents: 1,
+			errExpected:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			exporter, tp := setupTracerProvider()
+			hooks := NewOpenTelemetryHooks(tp, tt.traceOpts...)
+
+			server, client := twirptest.ServerAndClient(tt.service, hooks)
+			defer server.Close()
+
+			_, err := client.MakeHat(context.Background(), &twirptest.Size{})
+			if err != nil && !tt.errExpected {
+				t.Fatalf("twirptest Client err=%q", err)
+			}
+
+			spans := exporter.GetSpans()
+			if !assert.Len(t, spans, 1, "expected a server span") {
+				return
+			}
+			span := spans[0]
+			assert.Equal(t, "twirptest.Haberdasher/MakeHat", span.Name, "expected span name to be the full method name")
+			assert.Equal(t, trace.SpanKindServer, span.SpanKind)
+			assert.Equal(t, tt.expectedAttributes, span.Attributes, "expected attributes to match")
+			assert.Equal(t, tt.expectedStatus, span.Status, "expected status to match")
+			assert.Len(t, span.Events, tt.expectedEvents, "expected errors to be recorded")
+		})
+	}
+}
+
+func TestWithTraceContext(t *testing.T) {
+	exporter, tp := setupTracerProvider()
+	hooks := NewOpenTelemetryHooks(tp)
+	server := httptest.NewServer(WithTraceContext(twirptest.NewHaberdasherServer(twirptest.NoopHatmaker(), hooks)))
+	defer server.Close()
+
+	parentCtx, parent := tp.Tracer("test").Start(context.Background(), "parent")
+	client := twirptest.NewHaberdasherProtobufClient(server.URL, NewTraceHTTPClient(nil, tp))
+	_, err := client.MakeHat(parentCtx, &twirptest.Size{})
+	if err != nil {
+		t.Fatalf("twirptest client err=%q", err)
+	}
+	parent.End()
+
+	spans := exporter.GetSpans()
+	if !assert.Len(t, spans, 3, "expected server, client and parent spans") {
+		return
+	}
+	serverSpan, clientSpan := spans[0], spans[1]
+	assert.Equal(t, parent.SpanContext().TraceID(), serverSpan.SpanContext.TraceID(), "expected trace to propagate properly")
+	assert.Equal(t, clientSpan.SpanContext.SpanID(), serverSpan.Parent.SpanID(), "expected span to propagate properly")
+	assert.True(t, serverSpan.Parent.IsRemote(), "expected the server span parent to be remote")
+}
+
+func setupTracerProvider() (*tracetest.InMemoryExporter, *sdktrace.TracerProvider) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	return exporter, tp
+}
@@ -1,2 +1,4 @@
 // Package ottwirp provides OpenTracing support for any Twirp server.
 package ottwirp
+
+//go:generate protoc -I proto --go_out=. --go_opt=module=github.com/twirp-ecosystem/twirp-opentracing proto/ottwirp/options.proto
@@ -0,0 +1,214 @@
+package ottwirp
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	ot "github.com/opentracing/opentracing-go"
+)
+
+// payloadSizes counts the request and response body bytes of a single call.
+type payloadSizes struct {
+	request  byteCounter
+	response byteCounter
+
+	// traced is set once the server call has a span. The uncompressed size of
+	// gzip encoded bodies is only counted for traced calls.
+	traced bool
+}
+
+func (p *payloadSizes) setTags(span ot.Span) {
+	p.request.setTags(span, "rpc.request")
+	p.response.setTags(span, "rpc.response")
+}
+
+// trace marks the server call as traced, and starts counting the uncompressed
+// size of the request body if it is gzip encoded.
+func (p *payloadSizes) trace(header http.Header) {
+	p.traced = true
+	if isGzipEncoded(header) {
+		p.request.gzip = newGzipCounter()
+	}
+}
+
+// close stops the decompression of gzip encoded bodies, if any.
+func (p *payloadSizes) close() {
+	p.request.close()
+	p.response.close()
+}
+
+// byteCounter counts the bytes of a body as they are transferred. For gzip
+// encoded bodies it also decompresses a copy of the bytes to count the
+// uncompressed size.
+type byteCounter struct {
+	n int64
+
+	// decoded is set when the counted bytes were already decompressed by the
+	// HTTP transport, so the size on the wire is unknown.
+	decoded bool
+	gzip    *gzipCounter
+}
+
+func (c *byteCounter) count(p []byte) {
+	atomic.AddInt64(&c.n, int64(len(p)))
+	if c.gzip != nil {
+		_, _ = c.gzip.Write(p)
+	}
+}
+
+func (c *byteCounter) close() {
+	if c.gzip != nil {
+		c.gzip.size()
+	}
+}
+
+func (c *byteCounter) setTags(span ot.Span, prefix string) {
+	n := atomic.LoadInt64(&c.n)
+	if c.decoded {
+		span.SetTag(prefix+".uncompressed_size", n)
+		return
+	}
+
+	span.SetTag(prefix+".size", n)
+	if c.gzip != nil {
+		if size, ok := c.gzip.size(); ok {
+			span.SetTag(prefix+".uncompressed_size", size)
+		}
+	}
+}
+
+// gzipCounter decompresses the bytes written to it in the background and
+// counts the uncompressed bytes.
+type gzipCounter struct {
+	pw   *io.PipeWriter
+	done chan struct{}
+	once sync.Once
+	n    int64
+	err  error
+}
+
+func newGzipCounter() *gzipCounter {
+	pr, pw := io.Pipe()
+	g := &gzipCounter{
+		pw:   pw,
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(g.done)
+		zr, err := gzip.NewReader(pr)
+		if err == nil {
+			g.n, err = io.Copy(ioutil.Discard, zr)
+		}
+		g.err = err
+		// Drain whatever the decompressor did not consume so writers never block.
+		_, _ = io.Copy(ioutil.Discard, pr)
+	}()
+
+	return g
+}
+
+func (g *gzipCounter) Write(p []byte) (int, error) {
+	_, _ = g.pw.Write(p)
+	return len(p), nil
+}
+
+// size stops the decompression and returns the uncompressed size, if the
+// bytes written so far formed a valid gzip stream.
+func (g *gzipCounter) size() (int64, bool) {
+	g.once.Do(func() {
+		_ = g.pw.Close()
+	})
+	<-g.done
+	return g.n, g.err == nil
+}
+
+func isGzipEncoded(header http.Header) bool {
+	return strings.EqualFold(strings.TrimSpace(header.Get("Content-Encoding")), "gzip")
+}
+
+// countingReadCloser counts the bytes read from a body.
+type countingReadCloser struct {
+	io.ReadCloser
+	counter *byteCounter
+}
+
+func (r countingReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.counter.count(p[:n])
+	return n, err
+}
+
+// countingResponseWriter counts the bytes written to a response.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	sizes       *payloadSizes
+	wroteHeader bool
+}
+
+func (w *countingResponseWriter) WriteHeader(statusCode int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if w.sizes.traced && isGzipEncoded(w.Header()) {
+			w.sizes.response.gzip = newGzipCounter()
+		}
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.sizes.response.count(p[:n])
+	return n, err
+}
+
+func (w *countingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// countServerPayloads wraps the request body and response writer to count
+// the payload sizes of a request served by WithTraceContext. Gzip encoded bodies
+// are only decompressed once the hooks start a span for the request.
+func countServerPayloads(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, *payloadSizes) {
+	sizes := &payloadSizes{}
+	if r.Body != nil {
+		r.Body = countingReadCloser{ReadCloser: r.Body, counter: &sizes.request}
+	}
+
+	return &countingResponseWriter{ResponseWriter: w, sizes: sizes}, r, sizes
+}
+
+// countClientRequest wraps the body of an outgoing request to count its size.
+// The request passed in must already be a copy owned by the caller.
+func countClientRequest(req *http.Request) *payloadSizes {
+	sizes := &payloadSizes{}
+	if isGzipEncoded(req.Header) {
+		sizes.request.gzip = newGzipCounter()
+	}
+	if req.Body != nil {
+		req.Body = countingReadCloser{ReadCloser: req.Body, counter: &sizes.request}
+	}
+
+	return sizes
+}
+
+// countClientResponse wraps the body of a response to count its size.
+func (p *payloadSizes) countClientResponse(res *http.Response) {
+	switch {
+	case res.Uncompressed:
+		p.response.decoded = true
+	case isGzipEncoded(res.Header):
+		p.response.gzip = newGzipCounter()
+	}
+	res.Body = countingReadCloser{ReadCloser: res.Body, counter: &p.response}
+}
@@ -0,0 +1,155 @@
+package ottwirp
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/stretchr/testify/assert"
+	"github.com/twirp-ecosystem/twirptest"
+)
+
+func TestPayloadSizes(t *testing.T) {
+	size := &twirptest.Size{Inches: 12}
+	hat := &twirptest.Hat{Size: 12, Color: "blue", Name: "top hat"}
+	service := twirptest.HaberdasherFunc(func(context.Context, *twirptest.Size) (*twirptest.Hat, error) {
+		return hat, nil
+	})
+
+	t.Run("tags wire sizes on server and client spans", func(t *testing.T) {
+		tracer := setupMockTracer()
+		hooks := NewOpenTracingHooks(tracer)
+		server := httptest.NewServer(WithTraceContext(twirptest.NewHaberdasherServer(service, hooks), tracer, IncludePayloadSizes(true)))
+		defer server.Close()
+		client := twirptest.NewHaberdasherProtobufClient(server.URL, NewTraceHTTPClient(http.DefaultClient, tracer, IncludePayloadSizes(true)))
+
+		_, err := client.MakeHat(context.Background(), size)
+		if err != nil {
+			t.Fatalf("twirptest client err=%q", err)
+		}
+
+		serverSpan := tracer.FinishedSpans()[0]
+		clientSpan := tracer.FinishedSpans()[1]
+		for _, span := range []map[string]interface{}{serverSpan.Tags(), clientSpan.Tags()} {
+			assert.Equal(t, int64(proto.Size(size)), span["rpc.request.size"], "expected request size to match")
+			assert.Equal(t, int64(proto.Size(hat)), span["rpc.response.size"], "expected response size to match")
+			assert.NotContains(t, span, "rpc.request.uncompressed_size")
+			assert.NotContains(t, span, "rpc.response.uncompressed_size")
+		}
+	})
+
+	t.Run("tags uncompressed sizes for gzip encoded responses", func(t *testing.T) {
+		tracer := setupMockTracer()
+		hooks := NewOpenTracingHooks(tracer)
+		handler := gzipResponses(twirptest.NewHaberdasherServer(service, hooks))
+		server := httptest.NewServer(WithTraceContext(handler, tracer, IncludePayloadSizes(true)))
+		defer server.Close()
+		client := twirptest.NewHaberdasherProtobufClient(server.URL, NewTraceHTTPClient(http.DefaultClient, tracer, IncludePayloadSizes(true)))
+
+		_, err := client.MakeHat(context.Background(), size)
+		if err != nil {
+			t.Fatalf("twirptest client err=%q", err)
+		}
+
+		serverTags := tracer.FinishedSpans()[0].Tags()
+		assert.Equal(t, int64(proto.Size(size)), serverTags["rpc.request.size"], "expected request size to match")
+		assert.Equal(t, int64(proto.Size(hat)), serverTags["rpc.response.uncompressed_size"], "expected uncompressed response size to match")
+		assert.NotEqual(t, int64(proto.Size(hat)), serverTags["rpc.response.size"], "expected compressed response size on the wire")
+
+		// The transport decompresses the response, so the client only knows the
+		// uncompressed size.
+		clientTags := tracer.FinishedSpans()[1].Tags()
+		assert.Equal(t, int64(proto.Size(size)), clientTags["rpc.request.size"], "expected request size to match")
+		assert.Equal(t, int64(proto.Size(hat)), clientTags["rpc.response.uncompressed_size"], "expected uncompressed response size to match")
+		assert.NotContains(t, clientTags, "rpc.response.size")
+	})
+}
+
+func TestPayloadSizesGzipCounters(t *testing.T) {
+	tests := []struct {
+		desc    string
+		handler func(tracer *mocktracer.MockTracer) http.Handler
+		traced  bool
+	}{
+		{
+			desc: "traced requests decompress gzip bodies until they are served",
+			handler: func(tracer *mocktracer.MockTracer) http.Handler {
+				return twirptest.NewHaberdasherServer(twirptest.NoopHatmaker(), NewOpenTracingHooks(tracer))
+			},
+			traced: true,
+		},
+		{
+			desc: "filtered requests do not decompress gzip bodies",
+			handler: func(tracer *mocktracer.MockTracer) http.Handler {
+				hooks := NewOpenTracingHooks(tracer, DenyMethods(MethodRule{Method: "MakeHat"}))
+				return twirptest.NewHaberdasherServer(twirptest.NoopHatmaker(), hooks)
+			},
+		},
+		{
+			desc: "requests served without hooks do not decompress gzip bodies",
+			handler: func(*mocktracer.MockTracer) http.Handler {
+				return twirptest.NewHaberdasherServer(twirptest.NoopHatmaker(), nil)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			tracer := setupMockTracer()
+			var sizes *payloadSizes
+			h := gzipResponses(tt.handler(tracer))
+			handler := WithTraceContext(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				sizes = tracingInfoFromContext(r.Context()).sizes
+				h.ServeHTTP(w, r)
+			}), tracer, IncludePayloadSizes(true))
+
+			req := httptest.NewRequest("POST", "/twirp/twirptest.Haberdasher/MakeHat", strings.NewReader("\x1f\x8b"))
+			req.Header.Set("Content-Type", "application/protobuf")
+			req.Header.Set("Content-Encoding", "gzip")
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if !tt.traced {
+				assert.Nil(t, sizes.request.gzip, "expected the request body not to be decompressed")
+				assert.Nil(t, sizes.response.gzip, "expected the response body not to be decompressed")
+				assert.Empty(t, tracer.FinishedSpans(), "expected the request not to be traced")
+				return
+			}
+			for _, g := range []*gzipCounter{sizes.request.gzip, sizes.response.gzip} {
+				if !assert.NotNil(t, g, "expected the body to be decompressed") {
+					continue
+				}
+				select {
+				case <-g.done:
+				default:
+					t.Error("expected the decompression to stop once the request is served")
+				}
+			}
+		})
+	}
+}
+
+// gzipResponses compresses every response written by h.
+func gzipResponses(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		defer zw.Close()
+
+		h.ServeHTTP(gzipResponseWriter{ResponseWriter: w, w: zw}, r)
+	})
+}
+
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	w io.Writer
+}
+
+func (w gzipResponseWriter) Write(p []byte) (int, error) {
+	return w.w.Write(p)
+}
@@ -0,0 +1,130 @@
+package ottwirp
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	ot "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+// TrustProxies, if set, will make WithTraceContext take the peer address from
+// the X-Forwarded-For or X-Real-IP headers instead of the connection, trusting
+// the proxy the server is connected to. Clients can set any X-Forwarded-For
+// entries before the request reaches the proxy, so the address taken is the
+// rightmost entry, which the proxy appended, skipping the entries of proxies
+// in the networks set with TrustedProxies. Only set it if the server is only
+// reachable through proxies that set these headers, otherwise clients can
+// send any address. It is not set by default.
+func TrustProxies(trustProxies bool) TraceOption {
+	return func(opts *TraceOptions) {
+		opts.trustProxies = trustProxies
+	}
+}
+
+// TrustedProxies sets the networks of the proxies in front of the server, for
+// chains of proxies. Requests from a connection in these networks have their
+// peer address taken from the forwarded headers as with TrustProxies, and the
+// X-Forwarded-For entries in these networks are skipped, so the address taken
+// is the rightmost one that is not a trusted proxy. Calling TrustedProxies
+// multiple times adds to the networks.
+func TrustedProxies(networks ...netip.Prefix) TraceOption {
+	return func(opts *TraceOptions) {
+		opts.trustedProxies = append(opts.trustedProxies, networks...)
+	}
+}
+
+// requestInfo holds the attributes of a server request captured by
+// WithTraceContext, set as tags on the server span by the hooks.
+type requestInfo struct {
+	method    string
+	path      string
+	userAgent string
+
+	// peerHost is the IP address or host name of the client, and peerPort
+	// its port if known.
+	peerHost string
+	peerPort int
+}
+
+func newRequestInfo(r *http.Request, opts *TraceOptions) *requestInfo {
+	info := &requestInfo{
+		method:    r.Method,
+		path:      r.URL.Path,
+		userAgent: r.UserAgent(),
+	}
+
+	host, port, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// The address has no port, such as a Unix socket.
+		host, port = r.RemoteAddr, ""
+	}
+
+	if opts.trustProxies || isTrustedProxy(host, opts.trustedProxies) {
+		if client := forwardedFor(r.Header, opts.trustedProxies); client != "" {
+			info.peerHost = client
+			return info
+		}
+	}
+
+	info.peerHost = host
+	info.peerPort, _ = strconv.Atoi(port)
+	return info
+}
+
+// forwardedFor returns the client address set by trusted proxies, if any.
+// Each proxy appends the address it received the request from to
+// X-Forwarded-For, so the client is the rightmost address that is not a
+// trusted proxy. The leftmost address is used if every address is trusted.
+func forwardedFor(header http.Header, trustedProxies []netip.Prefix) string {
+	var hops []string
+	for _, value := range header.Values("X-Forwarded-For") {
+		hops = append(hops, splitList(value)...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if i == 0 || !isTrustedProxy(hops[i], trustedProxies) {
+			return hops[i]
+		}
+	}
+	return strings.TrimSpace(header.Get("X-Real-IP"))
+}
+
+// isTrustedProxy reports whether host is an IP address in one of the trusted
+// networks.
+func isTrustedProxy(host string, trustedProxies []netip.Prefix) bool {
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, network := range trustedProxies {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (info *requestInfo) setTags(span ot.Span) {
+	ext.HTTPMethod.Set(span, info.method)
+	ext.HTTPUrl.Set(span, info.path)
+	if info.userAgent != "" {
+		span.SetTag("http.user_agent", info.userAgent)
+	}
+
+	if ip := net.ParseIP(info.peerHost); ip == nil {
+		if info.peerHost != "" {
+			ext.PeerHostname.Set(span, info.peerHost)
+		}
+	} else if ip4 := ip.To4(); ip4 != nil {
+		ext.PeerHostIPv4.SetString(span, ip4.String())
+	} else {
+		ext.PeerHostIPv6.Set(span, ip.String())
+	}
+	if info.peerPort != 0 {
+		ext.PeerPort.Set(span, uint16(info.peerPort))
+	}
+}
@@ -0,0 +1,137 @@
+package ottwirp
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/twirp-ecosystem/twirptest"
+)
+
+func TestServerRequestTags(t *testing.T) {
+	tests := []struct {
+		desc         string
+		traceOpts    []TraceOption
+		remoteAddr   string
+		header       map[string]string
+		expectedTags map[string]interface{}
+	}{
+		{
+			desc:       "tags the request and the peer address",
+			remoteAddr: "192.0.2.1:1234",
+			header:     map[string]string{"User-Agent": "hatter/1.0"},
+			expectedTags: map[string]interface{}{
+				"http.method":     "POST",
+				"http.url":        "/twirp/twirptest.Haberdasher/MakeHat",
+				"http.user_agent": "hatter/1.0",
+				"peer.ipv4":       "192.0.2.1",
+				"peer.port":       uint16(1234),
+			},
+		},
+		{
+			desc:       "tags IPv6 peer addresses",
+			remoteAddr: "[2001:db8::1]:1234",
+			expectedTags: map[string]interface{}{
+				"peer.ipv6": "2001:db8::1",
+				"peer.ipv4": nil,
+			},
+		},
+		{
+			desc:       "tags peer host names",
+			remoteAddr: "@",
+			expectedTags: map[string]interface{}{
+				"peer.hostname": "@",
+				"peer.port":     nil,
+			},
+		},
+		{
+			desc:       "ignores forwarded headers by default",
+			remoteAddr: "192.0.2.1:1234",
+			header:     map[string]string{"X-Forwarded-For": "198.51.100.7, 192.0.2.1"},
+			expectedTags: map[string]interface{}{
+				"peer.ipv4": "192.0.2.1",
+			},
+		},
+		{
+			desc:       "takes the address appended by the proxy to X-Forwarded-For when trusting proxies",
+			traceOpts:  []TraceOption{TrustProxies(true)},
+			remoteAddr: "192.0.2.1:1234",
+			header:     map[string]string{"X-Forwarded-For": "203.0.113.9, 198.51.100.7"},
+			expectedTags: map[string]interface{}{
+				"peer.ipv4": "198.51.100.7",
+				"peer.port": nil,
+			},
+		},
+		{
+			desc:       "skips the addresses of trusted proxies in X-Forwarded-For",
+			traceOpts:  []TraceOption{TrustedProxies(netip.MustParsePrefix("192.0.2.0/24"))},
+			remoteAddr: "192.0.2.1:1234",
+			header:     map[string]string{"X-Forwarded-For": "203.0.113.9, 198.51.100.7, 192.0.2.5"},
+			expectedTags: map[string]interface{}{
+				"peer.ipv4": "198.51.100.7",
+			},
+		},
+		{
+			desc:       "takes the leftmost address if every address is a trusted proxy",
+			traceOpts:  []TraceOption{TrustedProxies(netip.MustParsePrefix("192.0.2.0/24"))},
+			remoteAddr: "192.0.2.1:1234",
+			header:     map[string]string{"X-Forwarded-For": "192.0.2.7, 192.0.2.5"},
+			expectedTags: map[string]interface{}{
+				"peer.ipv4": "192.0.2.7",
+			},
+		},
+		{
+			desc:       "ignores forwarded headers of connections from untrusted networks",
+			traceOpts:  []TraceOption{TrustedProxies(netip.MustParsePrefix("192.0.2.0/24"))},
+			remoteAddr: "203.0.113.9:1234",
+			header:     map[string]string{"X-Forwarded-For": "198.51.100.7"},
+			expectedTags: map[string]interface{}{
+				"peer.ipv4": "203.0.113.9",
+				"peer.port": uint16(1234),
+			},
+		},
+		{
+			desc:       "takes the client address from X-Real-IP when trusting proxies",
+			traceOpts:  []TraceOption{TrustProxies(true)},
+			remoteAddr: "192.0.2.1:1234",
+			header:     map[string]string{"X-Real-IP": "198.51.100.7"},
+			expectedTags: map[string]interface{}{
+				"peer.ipv4": "198.51.100.7",
+			},
+		},
+		{
+			desc:       "falls back to the connection when proxies set no header",
+			traceOpts:  []TraceOption{TrustProxies(true)},
+			remoteAddr: "192.0.2.1:1234",
+			expectedTags: map[string]interface{}{
+				"peer.ipv4": "192.0.2.1",
+				"peer.port": uint16(1234),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			tracer := setupMockTracer()
+			hooks := NewOpenTracingHooks(tracer)
+			handler := WithTraceContext(twirptest.NewHaberdasherServer(twirptest.NoopHatmaker(), hooks), tracer, tt.traceOpts...)
+
+			req := httptest.NewRequest("POST", "/twirp/twirptest.Haberdasher/MakeHat", nil)
+			req.RemoteAddr = tt.remoteAddr
+			req.Header.Set("Content-Type", "application/protobuf")
+			for key, value := range tt.header {
+				req.Header.Set(key, value)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			spans := tracer.FinishedSpans()
+			if !assert.Len(t, spans, 1, "expected a server span") {
+				return
+			}
+			for key, value := range tt.expectedTags {
+				assert.Equal(t, value, spans[0].Tag(key), "expected the %s tag to match", key)
+			}
+		})
+	}
+}
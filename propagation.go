@@ -0,0 +1,182 @@
+package ottwirp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	ot "github.com/opentracing/opentracing-go"
+	"github.com/twitchtv/twirp"
+)
+
+// Operations of a PropagationError.
+const (
+	ExtractOperation = "extract"
+	InjectOperation  = "inject"
+)
+
+// PropagationError is passed to the function set with WithErrorHandler when the
+// span context of a call cannot be extracted from or injected into its
+// headers.
+type PropagationError struct {
+	Kind CallKind
+	// Operation is ExtractOperation or InjectOperation.
+	Operation string
+
+	Package string
+	Service string
+	Method  string
+
+	// Peer and UserAgent identify the caller of server calls handled by
+	// WithTraceContext. Peer is the address tagged as peer.ipv4, peer.ipv6 or
+	// peer.hostname.
+	Peer      string
+	UserAgent string
+
+	Err error
+}
+
+func (e *PropagationError) Error() string {
+	return fmt.Sprintf("ottwirp: failed to %s the span context of a %s call: %v", e.Operation, e.Kind, e.Err)
+}
+
+func (e *PropagationError) Unwrap() error {
+	return e.Err
+}
+
+// PropagationErrorSink is implemented by MetricsSinks that count propagation
+// errors, such as MetricsRegistry.
+type PropagationErrorSink interface {
+	ObservePropagationError(err *PropagationError)
+}
+
+// WithErrorHandler defines a function called with a *PropagationError when the
+// span context of a call cannot be extracted from the request headers, as
+// they are malformed, or injected into them. Missing span contexts are not
+// errors. Propagation errors are also counted by the WithMetrics sink if it
+// implements PropagationErrorSink.
+//
+// The server hooks also call it once with ErrMissingTraceContext if they run
+// without WithTraceContext, so handlers should not assume every error is a
+// *PropagationError. It replaces the log line the hooks write by default in
+// that case.
+func WithErrorHandler(fn func(ctx context.Context, err error)) TraceOption {
+	return func(opts *TraceOptions) {
+		opts.errorHandler = fn
+	}
+}
+
+// handlePropagationError reports a failure to extract or inject the span
+// context of the call in ctx.
+func (opts *TraceOptions) handlePropagationError(ctx context.Context, kind CallKind, operation string, err error) {
+	if opts.errorHandler == nil && opts.metrics == nil {
+		return
+	}
+
+	perr := &PropagationError{
+		Kind:      kind,
+		Operation: operation,
+		Err:       err,
+	}
+	perr.Package, _ = twirp.PackageName(ctx)
+	perr.Service, _ = twirp.ServiceName(ctx)
+	perr.Method, _ = twirp.MethodName(ctx)
+	if info := tracingInfoFromContext(ctx); info != nil && kind == ServerCall {
+		perr.Peer = info.request.peerHost
+		perr.UserAgent = info.request.userAgent
+	}
+
+	if sink, ok := opts.metrics.(PropagationErrorSink); ok {
+		sink.ObservePropagationError(perr)
+	}
+	if opts.errorHandler != nil {
+		opts.errorHandler(ctx, perr)
+	}
+}
+
+// Propagator extracts span contexts from and injects them into HTTP headers
+// using a single propagation format.
+type Propagator interface {
+	Extract(tracer ot.Tracer, header http.Header) (ot.SpanContext, error)
+	Inject(tracer ot.Tracer, spanContext ot.SpanContext, header http.Header) error
+}
+
+// FormatPropagator returns a Propagator which uses the tracer's Inject and
+// Extract methods with the given format. The format can be any format the
+// tracer supports, such as a B3 format registered on a Jaeger tracer, as long
+// as it accepts an ot.HTTPHeadersCarrier.
+func FormatPropagator(format interface{}) Propagator {
+	return formatPropagator{format: format}
+}
+
+// HTTPHeadersPropagator returns the default Propagator, which uses the
+// tracer's ot.HTTPHeaders format.
+func HTTPHeadersPropagator() Propagator {
+	return FormatPropagator(ot.HTTPHeaders)
+}
+
+type formatPropagator struct {
+	format interface{}
+}
+
+func (p formatPropagator) Extract(tracer ot.Tracer, header http.Header) (ot.SpanContext, error) {
+	return tracer.Extract(p.format, ot.HTTPHeadersCarrier(header))
+}
+
+func (p formatPropagator) Inject(tracer ot.Tracer, spanContext ot.SpanContext, header http.Header) error {
+	return tracer.Inject(spanContext, p.format, ot.HTTPHeadersCarrier(header))
+}
+
+// WithPropagators defines the propagators used by WithTraceContext to extract
+// the span context of incoming requests, and by TraceHTTPClient and the client
+// hooks to inject it into outgoing requests. This allows a trace to stay
+// connected while callers migrate from one propagation format to another.
+//
+// The order of the propagators sets their precedence: the span context is
+// extracted by the first propagator that finds one, while injection writes the
+// headers of every propagator. It defaults to HTTPHeadersPropagator.
+func WithPropagators(propagators ...Propagator) TraceOption {
+	return func(opts *TraceOptions) {
+		opts.propagators = propagators
+	}
+}
+
+func (opts *TraceOptions) propagatorsOrDefault() []Propagator {
+	if len(opts.propagators) == 0 {
+		return []Propagator{HTTPHeadersPropagator()}
+	}
+	return opts.propagators
+}
+
+// extractWith returns the span context found by the first propagator that
+// finds one. If none does, it returns the first error other than
+// ot.ErrSpanContextNotFound, if any.
+func extractWith(propagators []Propagator, tracer ot.Tracer, header http.Header) (ot.SpanContext, error) {
+	var firstErr error
+	for _, propagator := range propagators {
+		spanContext, err := propagator.Extract(tracer, header)
+		if err == nil && spanContext != nil {
+			return spanContext, nil
+		}
+		if err != nil && err != ot.ErrSpanContextNotFound && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return nil, ot.ErrSpanContextNotFound
+}
+
+// injectWith injects the span context with every propagator, returning the
+// first error.
+func injectWith(propagators []Propagator, tracer ot.Tracer, spanContext ot.SpanContext, header http.Header) error {
+	var firstErr error
+	for _, propagator := range propagators {
+		if err := propagator.Inject(tracer, spanContext, header); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,227 @@
+package ottwirp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/stretchr/testify/assert"
+	"github.com/twirp-ecosystem/twirptest"
+)
+
+// testFormat is a propagation format registered on the mock tracer, standing
+// in for a second format such as B3 or W3C trace context.
+type testFormat struct{}
+
+const (
+	testTraceIDHeader = "X-Test-Trace-Id"
+	testSpanIDHeader  = "X-Test-Span-Id"
+)
+
+type testCodec struct{}
+
+func (testCodec) Inject(spanContext mocktracer.MockSpanContext, carrier interface{}) error {
+	header := http.Header(carrier.(opentracing.HTTPHeadersCarrier))
+	header.Set(testTraceIDHeader, strconv.Itoa(spanContext.TraceID))
+	header.Set(testSpanIDHeader, strconv.Itoa(spanContext.SpanID))
+	return nil
+}
+
+func (testCodec) Extract(carrier interface{}) (mocktracer.MockSpanContext, error) {
+	header := http.Header(carrier.(opentracing.HTTPHeadersCarrier))
+	if header.Get(testTraceIDHeader) == "" {
+		return mocktracer.MockSpanContext{}, opentracing.ErrSpanContextNotFound
+	}
+	traceID, err := strconv.Atoi(header.Get(testTraceIDHeader))
+	if err != nil {
+		return mocktracer.MockSpanContext{}, opentracing.ErrSpanContextCorrupted
+	}
+	spanID, err := strconv.Atoi(header.Get(testSpanIDHeader))
+	if err != nil {
+		return mocktracer.MockSpanContext{}, opentracing.ErrSpanContextCorrupted
+	}
+	return mocktracer.MockSpanContext{TraceID: traceID, SpanID: spanID, Sampled: true}, nil
+}
+
+func setupMockTracerWithTestFormat() *mocktracer.MockTracer {
+	tracer := setupMockTracer()
+	tracer.RegisterInjector(testFormat{}, testCodec{})
+	tracer.RegisterExtractor(testFormat{}, testCodec{})
+	return tracer
+}
+
+func TestWithPropagatorsInjectsEveryFormat(t *testing.T) {
+	tracer := setupMockTracerWithTestFormat()
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+	}))
+	defer server.Close()
+
+	client := NewTraceHTTPClient(http.DefaultClient, tracer, WithPropagators(HTTPHeadersPropagator(), FormatPropagator(testFormat{})))
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("http client err=%q", err)
+	}
+	res.Body.Close()
+
+	assert.NotEmpty(t, header.Get("Mockpfx-Ids-Traceid"), "expected the HTTP headers format to be injected")
+	assert.NotEmpty(t, header.Get(testTraceIDHeader), "expected the test format to be injected")
+}
+
+func TestWithPropagatorsConnectsEitherFormat(t *testing.T) {
+	serverPropagators := WithPropagators(HTTPHeadersPropagator(), FormatPropagator(testFormat{}))
+	for _, clientPropagator := range []Propagator{HTTPHeadersPropagator(), FormatPropagator(testFormat{})} {
+		tracer := setupMockTracerWithTestFormat()
+		hooks := NewOpenTracingHooks(tracer)
+		server := httptest.NewServer(WithTraceContext(twirptest.NewHaberdasherServer(twirptest.NoopHatmaker(), hooks), tracer, serverPropagators))
+		client := twirptest.NewHaberdasherProtobufClient(server.URL, NewTraceHTTPClient(http.DefaultClient, tracer, WithPropagators(clientPropagator)))
+
+		_, err := client.MakeHat(context.Background(), &twirptest.Size{})
+		server.Close()
+		if err != nil {
+			t.Fatalf("twirptest client err=%q", err)
+		}
+
+		serverSpan := tracer.FinishedSpans()[0]
+		clientSpan := tracer.FinishedSpans()[1]
+		assert.Equal(t, clientSpan.SpanContext.TraceID, serverSpan.SpanContext.TraceID, "expected trace to propagate properly")
+		assert.Equal(t, clientSpan.SpanContext.SpanID, serverSpan.ParentID, "expected span to propagate properly")
+	}
+}
+
+func TestWithPropagatorsPrecedence(t *testing.T) {
+	tracer := setupMockTracerWithTestFormat()
+	headersParent := tracer.StartSpan("headers")
+	testParent := tracer.StartSpan("test")
+
+	header := http.Header{}
+	_ = HTTPHeadersPropagator().Inject(tracer, headersParent.Context(), header)
+	_ = FormatPropagator(testFormat{}).Inject(tracer, testParent.Context(), header)
+
+	tests := []struct {
+		desc        string
+		propagators []Propagator
+		expected    opentracing.Span
+	}{
+		{
+			desc:        "HTTP headers take precedence",
+			propagators: []Propagator{HTTPHeadersPropagator(), FormatPropagator(testFormat{})},
+			expected:    headersParent,
+		},
+		{
+			desc:        "test format takes precedence",
+			propagators: []Propagator{FormatPropagator(testFormat{}), HTTPHeadersPropagator()},
+			expected:    testParent,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			hooks := NewOpenTracingHooks(tracer)
+			handler := WithTraceContext(twirptest.NewHaberdasherServer(twirptest.NoopHatmaker(), hooks), tracer, WithPropagators(tt.propagators...))
+			tracer.Reset()
+
+			req := httptest.NewRequest("POST", "/twirp/twirptest.Haberdasher/MakeHat", nil)
+			req.Header = header.Clone()
+			req.Header.Set("Content-Type", "application/protobuf")
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			serverSpan := tracer.FinishedSpans()[0]
+			expected := tt.expected.Context().(mocktracer.MockSpanContext)
+			assert.Equal(t, expected.TraceID, serverSpan.SpanContext.TraceID, "expected trace to match")
+			assert.Equal(t, expected.SpanID, serverSpan.ParentID, "expected parent span to match")
+		})
+	}
+}
+
+func TestExtractErrors(t *testing.T) {
+	tests := []struct {
+		desc        string
+		traceID     string
+		expectedErr error
+	}{
+		{
+			desc:        "reports malformed span contexts",
+			traceID:     "malformed",
+			expectedErr: opentracing.ErrSpanContextCorrupted,
+		},
+		{
+			desc: "does not report missing span contexts",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			tracer := setupMockTracerWithTestFormat()
+			registry := NewMetricsRegistry()
+			var errs []error
+			hooks := NewOpenTracingHooks(tracer, WithMetrics(registry), WithErrorHandler(func(ctx context.Context, err error) {
+				errs = append(errs, err)
+			}))
+			handler := WithTraceContext(twirptest.NewHaberdasherServer(twirptest.NoopHatmaker(), hooks), tracer, WithPropagators(FormatPropagator(testFormat{})))
+
+			req := httptest.NewRequest("POST", "/twirp/twirptest.Haberdasher/MakeHat", nil)
+			req.RemoteAddr = "192.0.2.1:1234"
+			req.Header.Set("Content-Type", "application/protobuf")
+			req.Header.Set("User-Agent", "hatter/1.0")
+			if tt.traceID != "" {
+				req.Header.Set(testTraceIDHeader, tt.traceID)
+				req.Header.Set(testSpanIDHeader, "1")
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			serverSpan := tracer.FinishedSpans()[0]
+			if tt.expectedErr == nil {
+				assert.Empty(t, errs, "expected no error to be reported")
+				assert.Nil(t, serverSpan.Tag("trace.extract_error"), "expected no extract error tag")
+				assert.Equal(t, uint64(0), registry.PropagationErrors(ServerCall, ExtractOperation), "expected no error to be counted")
+				return
+			}
+
+			assert.Equal(t, tt.expectedErr.Error(), serverSpan.Tag("trace.extract_error"), "expected the extract error to be tagged")
+			assert.Equal(t, 0, serverSpan.ParentID, "expected the span to start a new trace")
+			assert.Equal(t, uint64(1), registry.PropagationErrors(ServerCall, ExtractOperation), "expected the error to be counted")
+			if !assert.Len(t, errs, 1, "expected the error to be reported") {
+				return
+			}
+			assert.ErrorIs(t, errs[0], tt.expectedErr)
+			perr, ok := errs[0].(*PropagationError)
+			if assert.True(t, ok, "expected a *PropagationError") {
+				assert.Equal(t, ServerCall, perr.Kind)
+				assert.Equal(t, ExtractOperation, perr.Operation)
+				assert.Equal(t, "192.0.2.1", perr.Peer)
+				assert.Equal(t, "hatter/1.0", perr.UserAgent)
+			}
+		})
+	}
+}
+
+func TestInjectErrors(t *testing.T) {
+	tracer := setupMockTracer()
+	registry := NewMetricsRegistry()
+	var errs []error
+	server := httptest.NewServer(twirptest.NewHaberdasherServer(twirptest.NoopHatmaker(), nil))
+	defer server.Close()
+	httpClient := NewTraceHTTPClient(http.DefaultClient, tracer,
+		WithPropagators(FormatPropagator("unsupported")),
+		WithMetrics(registry),
+		WithErrorHandler(func(ctx context.Context, err error) {
+			errs = append(errs, err)
+		}))
+	client := twirptest.NewHaberdasherProtobufClient(server.URL, httpClient)
+
+	_, err := client.MakeHat(context.Background(), &twirptest.Size{})
+	assert.NoError(t, err)
+
+	assert.Equal(t, uint64(1), registry.PropagationErrors(ClientCall, InjectOperation), "expected the error to be counted")
+	if assert.Len(t, errs, 1, "expected the error to be reported") {
+		assert.ErrorIs(t, errs[0], opentracing.ErrUnsupportedFormat)
+		assert.EqualError(t, errs[0], "ottwirp: failed to inject the span context of a client call: opentracing: Unknown or unsupported Inject/Extract format")
+	}
+}
@@ -0,0 +1,357 @@
+package ottwirp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	ot "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/twitchtv/twirp"
+)
+
+const (
+	// DefaultMaxAttempts is the number of attempts per call, including the
+	// first one, when RetryPolicy.MaxAttempts is not set.
+	DefaultMaxAttempts = 3
+
+	// TransportErrorReason is the retry reason of attempts that failed
+	// without a response, see RetryPolicy.RetryTransportErrors.
+	TransportErrorReason = "transport_error"
+)
+
+// DefaultRetryCodes are the Twirp error codes retried when RetryPolicy.Codes is
+// not set.
+var DefaultRetryCodes = []twirp.ErrorCode{twirp.Unavailable, twirp.ResourceExhausted}
+
+// RetryPolicy decides which calls of a RetryingHTTPClient are retried, and how
+// long to wait between attempts. The zero value retries the DefaultRetryCodes
+// up to DefaultMaxAttempts times with an exponential backoff.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts per call, including the
+	// first one.
+	MaxAttempts int
+	// Codes are the Twirp error codes of the responses that are retried.
+	Codes []twirp.ErrorCode
+	// RetryTransportErrors retries attempts that failed without a response,
+	// other than by the cancellation of the call. The server may have handled
+	// the request, so it is only safe for idempotent methods.
+	RetryTransportErrors bool
+	// Backoff returns how long to wait after the given failed attempt,
+	// starting at 1. It defaults to 50ms doubled after each attempt, up to 1s.
+	Backoff func(attempt int) time.Duration
+}
+
+// WithRetryPolicy sets the retry policy of a RetryingHTTPClient.
+func WithRetryPolicy(policy RetryPolicy) TraceOption {
+	return func(opts *TraceOptions) {
+		opts.retryPolicy = policy
+	}
+}
+
+func (p RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts <= 0 {
+		return DefaultMaxAttempts
+	}
+	return p.MaxAttempts
+}
+
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	if p.Backoff != nil {
+		return p.Backoff(attempt)
+	}
+	backoff := 50 * time.Millisecond
+	for i := 1; i < attempt && backoff < time.Second; i++ {
+		backoff *= 2
+	}
+	if backoff > time.Second {
+		backoff = time.Second
+	}
+	return backoff
+}
+
+// retryReason returns why an attempt that failed with err or errorCode should
+// be retried, or an empty string if it should not.
+func (p RetryPolicy) retryReason(err error, errorCode twirp.ErrorCode) string {
+	if err != nil {
+		if p.RetryTransportErrors && errorCode == twirp.Internal {
+			return TransportErrorReason
+		}
+		return ""
+	}
+
+	codes := p.Codes
+	if codes == nil {
+		codes = DefaultRetryCodes
+	}
+	for _, code := range codes {
+		if code == errorCode {
+			return string(code)
+		}
+	}
+	return ""
+}
+
+// RetryingHTTPClient wraps a provided http.Client to retry failed Twirp calls
+// according to a RetryPolicy. Each call is traced as a span with a child span
+// per attempt, tagged with retry.attempt, retry.backoff_ms, the time waited
+// before the attempt, and retry.reason, the reason the previous attempt was
+// retried.
+type RetryingHTTPClient struct {
+	attempts *TraceHTTPClient
+	tracer   ot.Tracer
+	opts     *TraceOptions
+}
+
+var _ HTTPClient = (*RetryingHTTPClient)(nil)
+
+// NewRetryingHTTPClient returns a RetryingHTTPClient. The options apply to both
+// the call and attempt spans, except for the metrics, which are recorded once
+// per call.
+func NewRetryingHTTPClient(client HTTPClient, tracer ot.Tracer, opts ...TraceOption) *RetryingHTTPClient {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	clientOpts := &TraceOptions{
+		includeClientErrors:  true,
+		includeCancellations: true,
+	}
+
+	for _, opt := range opts {
+		opt(clientOpts)
+	}
+
+	attemptOpts := *clientOpts
+	attemptOpts.metrics = nil
+
+	return &RetryingHTTPClient{
+		attempts: &TraceHTTPClient{
+			client: client,
+			tracer: tracer,
+			opts:   &attemptOpts,
+		},
+		tracer: tracer,
+		opts:   clientOpts,
+	}
+}
+
+// Do sends the request until it succeeds, fails with an error that is not
+// retried, or runs out of attempts, and returns the last response. If the
+// request is already traced by the hooks from NewOpenTracingClientHooks, the
+// hook's span is the parent of the attempt spans.
+//
+// Requests without a GetBody function have their body buffered so it can be
+// sent again.
+func (c *RetryingHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	req, err := rewindBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := withEncoding(req.Context(), req.Header)
+	call := &clientCall{
+		ctx:   ctx,
+		start: time.Now(),
+	}
+
+	if hooksCall := clientHooksCallFromContext(ctx); hooksCall != nil {
+		// The hooks record the span and metrics of the call. The attempts
+		// are hidden from TraceHTTPClient so they get spans of their own.
+		if hooksCall.span != nil {
+			call.span = hooksCall.span
+			ctx = context.WithValue(ctx, clientHooksCallKey{}, (*clientHooksCall)(nil))
+			ctx = ot.ContextWithSpan(ctx, call.span)
+		}
+	} else {
+		call.metrics = c.opts.metrics
+		if c.opts.shouldTrace(ctx) {
+			ctx = c.startCallSpan(ctx, req, call)
+		}
+	}
+
+	policy := c.opts.retryPolicy
+	attempt := &retryAttempt{}
+	for {
+		attempt.number++
+		attemptReq := req.WithContext(context.WithValue(ctx, retryAttemptKey{}, attempt))
+		if attempt.number > 1 && req.GetBody != nil {
+			if attemptReq.Body, err = req.GetBody(); err != nil {
+				call.errorCode = twirp.Internal
+				return nil, c.finishCall(call, attempt.number-1, nil, err)
+			}
+		}
+
+		res, err := c.attempts.Do(attemptReq)
+		errorCode := c.attemptErrorCode(res, err)
+		reason := policy.retryReason(err, errorCode)
+		if reason == "" || attempt.number >= policy.maxAttempts() {
+			call.errorCode = errorCode
+			return res, c.finishCall(call, attempt.number, res, err)
+		}
+
+		// The attempt is done before the backoff, so its span does not cover
+		// the wait.
+		if res != nil {
+			releaseBody(res)
+		}
+		backoff := policy.backoff(attempt.number)
+		if !sleepContext(ctx, backoff) {
+			call.errorCode = errorCode
+			return res, c.finishCall(call, attempt.number, res, err)
+		}
+
+		attempt = &retryAttempt{number: attempt.number, backoff: backoff, reason: reason}
+	}
+}
+
+// releaseBody reads the body of a failed attempt and closes it, finishing the
+// attempt, and replaces it with a copy of the bytes read, up to
+// maxErrorBodySize, in case the response is returned to the caller.
+func releaseBody(res *http.Response) {
+	buf, _ := ioutil.ReadAll(io.LimitReader(res.Body, maxErrorBodySize))
+	res.Body.Close()
+	res.Body = ioutil.NopCloser(bytes.NewReader(buf))
+}
+
+func (c *RetryingHTTPClient) startCallSpan(ctx context.Context, req *http.Request, call *clientCall) context.Context {
+	tracer := c.opts.clientTracer(req, c.tracer)
+	span, ctx := ot.StartSpanFromContextWithTracer(ctx, tracer, c.opts.operationName(ctx, req), ext.SpanKindRPCClient)
+	ext.HTTPMethod.Set(span, req.Method)
+	ext.HTTPUrl.Set(span, req.URL.String())
+	setEncodingTag(ctx, span)
+	call.span = span
+	call.finishSpan = true
+
+	for _, tag := range c.opts.tags {
+		span.SetTag(tag.Key, tag.Value)
+	}
+
+	if c.opts.ctxTagFn != nil {
+		for _, tag := range c.opts.ctxTagFn(ctx) {
+			span.SetTag(tag.Key, tag.Value)
+		}
+	}
+
+	c.opts.setContextBaggage(ctx, span)
+	c.opts.setBaggageTags(span)
+	tagDeadline(ctx, span)
+	return ctx
+}
+
+// attemptErrorCode returns the Twirp error code of a failed attempt. The body
+// of error responses is left intact, and is peeked below the closer of the
+// attempt, if TraceHTTPClient tracks it, so reading it does not finish the
+// attempt.
+func (c *RetryingHTTPClient) attemptErrorCode(res *http.Response, err error) twirp.ErrorCode {
+	if err != nil {
+		return transportErrorCode(err)
+	}
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return ""
+	}
+
+	var twerr twirp.Error
+	if body, ok := res.Body.(*closer); ok {
+		twerr, body.ReadCloser = peekTwirpError(body.ReadCloser)
+	} else {
+		// The attempt was sent without TraceHTTPClient tracking it, as the
+		// client hooks own the call and filtered it out.
+		twerr, res.Body = peekTwirpError(res.Body)
+	}
+	if twerr == nil {
+		return errorCodeFromStatus(res.StatusCode)
+	}
+	return twerr.Code()
+}
+
+// finishCall records the outcome of the last attempt on the call span, and
+// finishes the call once the response body is done, if there is one. It
+// returns err.
+func (c *RetryingHTTPClient) finishCall(call *clientCall, attempts int, res *http.Response, err error) error {
+	if call.span != nil {
+		call.span.SetTag("retry.attempts", attempts)
+	}
+
+	if err != nil {
+		if call.finishSpan {
+			setTransportErrorSpan(call.span, err, c.opts)
+		}
+		call.finish()
+		return err
+	}
+
+	if call.finishSpan {
+		ext.HTTPStatusCode.Set(call.span, uint16(res.StatusCode))
+		if res.StatusCode >= 400 && c.opts.includeClientErrors || res.StatusCode >= 500 {
+			call.span.SetTag("error", true)
+		}
+	}
+
+	res.Body = &closer{
+		ReadCloser: res.Body,
+		call:       call,
+	}
+	call.watch(c.opts.maxSpanLifetime)
+	return nil
+}
+
+type retryAttemptKey struct{}
+
+// retryAttempt is an attempt of a RetryingHTTPClient call, tagged on its span
+// by TraceHTTPClient.
+type retryAttempt struct {
+	number  int
+	backoff time.Duration
+	reason  string
+}
+
+func retryAttemptFromContext(ctx context.Context) *retryAttempt {
+	attempt, _ := ctx.Value(retryAttemptKey{}).(*retryAttempt)
+	return attempt
+}
+
+func (a *retryAttempt) setTags(span ot.Span) {
+	span.SetTag("retry.attempt", a.number)
+	if a.number > 1 {
+		span.SetTag("retry.backoff_ms", a.backoff.Milliseconds())
+		span.SetTag("retry.reason", a.reason)
+	}
+}
+
+// rewindBody returns req, or a copy of req with its body buffered if it has no
+// GetBody function to send it again.
+func rewindBody(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody || req.GetBody != nil {
+		return req, nil
+	}
+
+	b, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	req = req.WithContext(req.Context())
+	req.Body = ioutil.NopCloser(bytes.NewReader(b))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(b)), nil
+	}
+	return req, nil
+}
+
+// sleepContext waits for d, and reports whether ctx is still running.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
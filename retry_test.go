@@ -0,0 +1,218 @@
+package ottwirp
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/twirp-ecosystem/twirptest"
+	"github.com/twitchtv/twirp"
+)
+
+// flakyHatmaker fails with err the first n calls.
+func flakyHatmaker(n int32, err error) (twirptest.Haberdasher, *int32) {
+	var calls int32
+	return twirptest.HaberdasherFunc(func(ctx context.Context, s *twirptest.Size) (*twirptest.Hat, error) {
+		if atomic.AddInt32(&calls, 1) <= n {
+			return nil, err
+		}
+		return &twirptest.Hat{Size: s.Inches}, nil
+	}), &calls
+}
+
+func TestRetryingHTTPClient(t *testing.T) {
+	noBackoff := func(int) time.Duration { return time.Millisecond }
+
+	tests := []struct {
+		desc             string
+		failures         int32
+		err              error
+		policy           RetryPolicy
+		expectedAttempts int
+		expectedCode     twirp.ErrorCode
+	}{
+		{
+			desc:             "unavailable calls are retried until they succeed",
+			failures:         2,
+			err:              twirp.NewError(twirp.Unavailable, "unavailable"),
+			policy:           RetryPolicy{Backoff: noBackoff},
+			expectedAttempts: 3,
+		},
+		{
+			desc:             "resource exhausted calls are retried",
+			failures:         1,
+			err:              twirp.NewError(twirp.ResourceExhausted, "slow down"),
+			policy:           RetryPolicy{Backoff: noBackoff},
+			expectedAttempts: 2,
+		},
+		{
+			desc:             "retries stop after the maximum number of attempts",
+			failures:         5,
+			err:              twirp.NewError(twirp.Unavailable, "unavailable"),
+			policy:           RetryPolicy{MaxAttempts: 2, Backoff: noBackoff},
+			expectedAttempts: 2,
+			expectedCode:     twirp.Unavailable,
+		},
+		{
+			desc:             "other codes are not retried",
+			failures:         1,
+			err:              twirp.NotFoundError("not found"),
+			policy:           RetryPolicy{Backoff: noBackoff},
+			expectedAttempts: 1,
+			expectedCode:     twirp.NotFound,
+		},
+		{
+			desc:             "retried codes are configurable",
+			failures:         1,
+			err:              twirp.NewError(twirp.Aborted, "aborted"),
+			policy:           RetryPolicy{Codes: []twirp.ErrorCode{twirp.Aborted}, Backoff: noBackoff},
+			expectedAttempts: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			tracer := setupMockTracer()
+			service, calls := flakyHatmaker(tt.failures, tt.err)
+			server := httptest.NewServer(twirptest.NewHaberdasherServer(service, nil))
+			defer server.Close()
+			registry := NewMetricsRegistry()
+			client := twirptest.NewHaberdasherProtobufClient(server.URL, NewRetryingHTTPClient(http.DefaultClient, tracer, WithRetryPolicy(tt.policy), WithMetrics(registry)))
+
+			_, err := client.MakeHat(context.Background(), &twirptest.Size{Inches: 7})
+			if tt.expectedCode != "" {
+				if twerr, ok := err.(twirp.Error); assert.True(t, ok, "expected a twirp error") {
+					assert.Equal(t, tt.expectedCode, twerr.Code())
+				}
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, int32(tt.expectedAttempts), atomic.LoadInt32(calls), "expected the service to be called once per attempt")
+
+			spans := tracer.FinishedSpans()
+			if !assert.Len(t, spans, tt.expectedAttempts+1, "expected a span per attempt and a call span") {
+				return
+			}
+			call := spans[len(spans)-1]
+			assert.Equal(t, tt.expectedAttempts, call.Tag("retry.attempts"), "expected the attempts to be counted")
+			assert.Equal(t, tt.expectedCode != "", call.Tag("error") == true, "expected the call span error to match the last attempt")
+
+			for i, attempt := range spans[:tt.expectedAttempts] {
+				assert.Equal(t, call.SpanContext.SpanID, attempt.ParentID, "expected attempts to be children of the call span")
+				assert.Equal(t, i+1, attempt.Tag("retry.attempt"), "expected the attempt number to be tagged")
+				if i == 0 {
+					assert.Nil(t, attempt.Tag("retry.reason"), "expected no retry reason on the first attempt")
+					continue
+				}
+				assert.Equal(t, string(tt.err.(twirp.Error).Code()), attempt.Tag("retry.reason"), "expected the retry reason to be tagged")
+				assert.Equal(t, int64(1), attempt.Tag("retry.backoff_ms"), "expected the backoff to be tagged")
+			}
+
+			requests := registry.Requests(ClientCall, "twirptest", "Haberdasher", "MakeHat")
+			assert.Equal(t, uint64(1), requests, "expected the call to be counted once")
+		})
+	}
+}
+
+func TestRetryingHTTPClientWithinFilteredClientHooks(t *testing.T) {
+	tracer := setupMockTracer()
+	service, calls := flakyHatmaker(1, twirp.NewError(twirp.ResourceExhausted, "slow down"))
+	server := httptest.NewServer(twirptest.NewHaberdasherServer(service, nil))
+	defer server.Close()
+
+	deny := DenyMethods(MethodRule{Method: "MakeHat"})
+	httpClient := NewRetryingHTTPClient(http.DefaultClient, tracer, deny, WithRetryPolicy(RetryPolicy{
+		Codes:   []twirp.ErrorCode{twirp.ResourceExhausted},
+		Backoff: func(int) time.Duration { return 0 },
+	}))
+	client := hookedHaberdasherClient(server.URL, httpClient, NewOpenTracingClientHooks(tracer, deny))
+
+	_, err := client.MakeHat(context.Background(), &twirptest.Size{Inches: 7})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(calls), "expected the resource exhausted call to be retried")
+}
+
+func TestRetryingHTTPClientAttemptsEndBeforeBackoff(t *testing.T) {
+	const backoff = 100 * time.Millisecond
+	tracer := setupMockTracer()
+	service, _ := flakyHatmaker(1, twirp.NewError(twirp.Unavailable, "unavailable"))
+	server := httptest.NewServer(twirptest.NewHaberdasherServer(service, nil))
+	defer server.Close()
+	client := twirptest.NewHaberdasherProtobufClient(server.URL, NewRetryingHTTPClient(http.DefaultClient, tracer, WithRetryPolicy(RetryPolicy{
+		Backoff: func(int) time.Duration { return backoff },
+	})))
+
+	_, err := client.MakeHat(context.Background(), &twirptest.Size{Inches: 7})
+	assert.NoError(t, err)
+
+	spans := tracer.FinishedSpans()
+	if !assert.Len(t, spans, 3, "expected a span per attempt and a call span") {
+		return
+	}
+	retried := spans[0]
+	assert.Equal(t, 1, retried.Tag("retry.attempt"), "expected the first span to be the retried attempt")
+	assert.Less(t, retried.FinishTime.Sub(retried.StartTime), backoff, "expected the retried attempt to end before the backoff")
+	assert.GreaterOrEqual(t, spans[1].StartTime.Sub(retried.FinishTime), backoff, "expected the next attempt to start after the backoff")
+}
+
+func TestRetryingHTTPClientRewindsBodies(t *testing.T) {
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		if len(bodies) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = io.WriteString(w, `{"code":"unavailable","msg":"unavailable"}`)
+		}
+	}))
+	defer server.Close()
+
+	tracer := setupMockTracer()
+	client := NewRetryingHTTPClient(http.DefaultClient, tracer, WithRetryPolicy(RetryPolicy{
+		Backoff: func(int) time.Duration { return 0 },
+	}))
+
+	// Wrapping the reader hides it from http.NewRequest, so the request has
+	// no GetBody function.
+	req, err := http.NewRequest("POST", server.URL, struct{ io.Reader }{strings.NewReader("hat")})
+	if err != nil {
+		t.Fatalf("http.NewRequest err=%q", err)
+	}
+	res, err := client.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	res.Body.Close()
+
+	assert.Equal(t, []string{"hat", "hat"}, bodies, "expected the body to be sent with each attempt")
+	assert.Len(t, tracer.FinishedSpans(), 3, "expected a span per attempt and a call span")
+}
+
+func TestRetryingHTTPClientStopsWhenCanceled(t *testing.T) {
+	tracer := setupMockTracer()
+	service, calls := flakyHatmaker(5, twirp.NewError(twirp.Unavailable, "unavailable"))
+	server := httptest.NewServer(twirptest.NewHaberdasherServer(service, nil))
+	defer server.Close()
+	client := twirptest.NewHaberdasherProtobufClient(server.URL, NewRetryingHTTPClient(http.DefaultClient, tracer, WithRetryPolicy(RetryPolicy{
+		Backoff: func(int) time.Duration { return time.Minute },
+	})))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := client.MakeHat(ctx, &twirptest.Size{})
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(calls), "expected no retry once the call is done")
+
+	spans := tracer.FinishedSpans()
+	if assert.Len(t, spans, 2, "expected an attempt span and a call span") {
+		assert.Equal(t, 1, spans[1].Tag("retry.attempts"), "expected a single attempt")
+		assert.Equal(t, true, spans[1].Tag("error"), "expected the call span to be marked as an error")
+	}
+}
@@ -0,0 +1,146 @@
+package ottwirp
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	ot "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/twitchtv/twirp"
+)
+
+type clientHooksCallKey struct{}
+
+// clientHooksCall is attached to the context of calls seen by
+// TraceClientHooks. Its span is nil if the call was filtered out.
+type clientHooksCall struct {
+	span  ot.Span
+	start time.Time
+}
+
+// TraceClientHooks records OpenTracing client spans from the twirp.ClientHooks
+// lifecycle.
+type TraceClientHooks struct {
+	Tracer ot.Tracer
+	opts   *TraceOptions
+}
+
+// NewOpenTracingClientHooks provides a twirp.ClientHooks struct which records
+// OpenTracing client spans. Unlike TraceHTTPClient, the hooks know the Twirp
+// package, service and method of every call and see the Twirp error returned
+// to the caller.
+//
+// The hooks inject the span context into the outgoing request headers, and a
+// TraceHTTPClient used by the same Twirp client reuses the hook's span instead
+// of starting its own.
+func NewOpenTracingClientHooks(tracer ot.Tracer, opts ...TraceOption) *twirp.ClientHooks {
+	clientOpts := &TraceOptions{
+		includeClientErrors:  true,
+		includeCancellations: true,
+	}
+
+	for _, opt := range opts {
+		opt(clientOpts)
+	}
+
+	traceHooks := &TraceClientHooks{
+		Tracer: tracer,
+		opts:   clientOpts,
+	}
+
+	return traceHooks.TwirpHooks()
+}
+
+func (t *TraceClientHooks) TwirpHooks() *twirp.ClientHooks {
+	return &twirp.ClientHooks{
+		RequestPrepared:  t.startTraceSpan,
+		ResponseReceived: t.finishTrace,
+		Error:            t.handleError,
+	}
+}
+
+func (t *TraceClientHooks) startTraceSpan(ctx context.Context, req *http.Request) (context.Context, error) {
+	start := time.Now()
+	ctx = withEncoding(ctx, req.Header)
+	if !t.opts.shouldTrace(ctx) {
+		injectParentSpanCtx(ctx, req.Header, t.opts)
+		return context.WithValue(ctx, clientHooksCallKey{}, &clientHooksCall{start: start}), nil
+	}
+
+	operationName := t.opts.operationName(ctx, req)
+	span, ctx := ot.StartSpanFromContextWithTracer(ctx, t.opts.clientTracer(req, t.Tracer), operationName, ext.SpanKindRPCClient)
+	span.SetTag("component", "twirp")
+	ext.HTTPMethod.Set(span, req.Method)
+	ext.HTTPUrl.Set(span, req.URL.String())
+	setEncodingTag(ctx, span)
+
+	if packageName, ok := twirp.PackageName(ctx); ok {
+		span.SetTag("package", packageName)
+	}
+
+	if serviceName, ok := twirp.ServiceName(ctx); ok {
+		span.SetTag("service", serviceName)
+	}
+
+	if methodName, ok := twirp.MethodName(ctx); ok {
+		span.SetTag("method", methodName)
+	}
+
+	for _, tag := range t.opts.tags {
+		span.SetTag(tag.Key, tag.Value)
+	}
+
+	if t.opts.ctxTagFn != nil {
+		for _, tag := range t.opts.ctxTagFn(ctx) {
+			span.SetTag(tag.Key, tag.Value)
+		}
+	}
+
+	t.opts.setContextBaggage(ctx, span)
+	t.opts.setBaggageTags(span)
+	tagDeadline(ctx, span)
+	injectSpanCtx(ctx, span, req.Header, t.opts)
+
+	return context.WithValue(ctx, clientHooksCallKey{}, &clientHooksCall{span: span, start: start}), nil
+}
+
+func (t *TraceClientHooks) finishTrace(ctx context.Context) {
+	call := clientHooksCallFromContext(ctx)
+	if call == nil {
+		return
+	}
+	t.observeCall(ctx, call, "")
+
+	if call.span != nil {
+		call.span.Finish()
+	}
+}
+
+func (t *TraceClientHooks) handleError(ctx context.Context, err twirp.Error) {
+	call := clientHooksCallFromContext(ctx)
+	if call == nil {
+		return
+	}
+	t.observeCall(ctx, call, err.Code())
+
+	if call.span == nil {
+		return
+	}
+
+	setTwirpErrorSpan(ctx, call.span, err, t.opts)
+	call.span.Finish()
+}
+
+func (t *TraceClientHooks) observeCall(ctx context.Context, call *clientHooksCall, errorCode twirp.ErrorCode) {
+	if t.opts.metrics != nil {
+		t.opts.metrics.ObserveCall(newCallMetrics(ctx, ClientCall, call.start, errorCode))
+	}
+}
+
+// clientHooksCallFromContext returns the call seen by TraceClientHooks in ctx,
+// if any.
+func clientHooksCallFromContext(ctx context.Context) *clientHooksCall {
+	call, _ := ctx.Value(clientHooksCallKey{}).(*clientHooksCall)
+	return call
+}
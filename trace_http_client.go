@@ -1,8 +1,14 @@
 package ottwirp
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"sync"
+	"time"
 
 	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/ext"
@@ -31,7 +37,8 @@ func NewTraceHTTPClient(client HTTPClient, tracer opentracing.Tracer, opts ...Tr
 	}
 
 	clientOpts := &TraceOptions{
-		includeClientErrors: true,
+		includeClientErrors:  true,
+		includeCancellations: true,
 	}
 
 	for _, opt := range opts {
@@ -45,32 +52,93 @@ func NewTraceHTTPClient(client HTTPClient, tracer opentracing.Tracer, opts ...Tr
 	}
 }
 
+// WithMaxSpanLifetime sets how long TraceHTTPClient waits for a response body
+// to be read to EOF or closed before it finishes the span anyway, tagging it
+// with span.leaked. This bounds the spans of callers that never close response
+// bodies. It is disabled by default.
+func WithMaxSpanLifetime(maxLifetime time.Duration) TraceOption {
+	return func(opts *TraceOptions) {
+		opts.maxSpanLifetime = maxLifetime
+	}
+}
+
 // Do injects the tracing headers into the tracer and updates the headers before
-// making the actual request.
+// making the actual request. If the request is already traced by the hooks
+// from NewOpenTracingClientHooks, Do only injects the hook's span context.
+// Requests that do not pass the filters are sent without a span, propagating
+// the span in the request context, if any.
+//
+// The span is finished once the response body has been read to EOF or closed,
+// whichever comes first, or once the lifetime set by WithMaxSpanLifetime has
+// passed.
 func (c *TraceHTTPClient) Do(req *http.Request) (*http.Response, error) {
-	ctx := req.Context()
-	methodName, ok := twirp.MethodName(ctx)
-	if !ok {
-		// No method name, let's use the URL path instead then.
-		methodName = req.URL.Path
+	ctx := withEncoding(req.Context(), req.Header)
+	if hooksCall := clientHooksCallFromContext(ctx); hooksCall != nil {
+		// The hooks record the span and metrics of the call.
+		if hooksCall.span == nil {
+			return c.client.Do(req)
+		}
+		injectSpanCtx(ctx, hooksCall.span, req.Header, c.opts)
+		return c.do(req, &clientCall{span: hooksCall.span})
+	}
+
+	call := &clientCall{
+		ctx:     ctx,
+		start:   time.Now(),
+		metrics: c.opts.metrics,
 	}
-	span, ctx := opentracing.StartSpanFromContext(ctx, methodName, ext.SpanKindRPCClient)
+
+	if !c.opts.shouldTrace(ctx) {
+		injectParentSpanCtx(ctx, req.Header, c.opts)
+		res, err := c.do(req, call)
+		if err != nil {
+			call.errorCode = transportErrorCode(err)
+			call.finish()
+			return res, err
+		}
+		if res.StatusCode < 200 || res.StatusCode >= 300 {
+			call.errorCode = c.responseErrorCode(res)
+		}
+		call.watch(c.opts.maxSpanLifetime)
+		return res, nil
+	}
+
+	operationName := c.opts.operationName(ctx, req)
+	tracer := c.opts.clientTracer(req, c.tracer)
+	span, ctx := opentracing.StartSpanFromContextWithTracer(ctx, tracer, operationName, ext.SpanKindRPCClient)
 	ext.HTTPMethod.Set(span, req.Method)
 	ext.HTTPUrl.Set(span, req.URL.String())
+	setEncodingTag(ctx, span)
+	call.span = span
+	call.finishSpan = true
 
-	err := c.tracer.Inject(span.Context(),
-		opentracing.HTTPHeaders,
-		opentracing.HTTPHeadersCarrier(req.Header),
-	)
-	if err != nil {
-		span.LogFields(otlog.String("event", "tracer.Inject() failed"), otlog.Error(err))
+	for _, tag := range c.opts.tags {
+		span.SetTag(tag.Key, tag.Value)
 	}
+
+	if c.opts.ctxTagFn != nil {
+		for _, tag := range c.opts.ctxTagFn(ctx) {
+			span.SetTag(tag.Key, tag.Value)
+		}
+	}
+
+	if attempt := retryAttemptFromContext(ctx); attempt != nil {
+		attempt.setTags(span)
+	}
+
+	c.opts.setContextBaggage(ctx, span)
+	c.opts.setBaggageTags(span)
+	tagDeadline(ctx, span)
+	injectSpanCtx(ctx, span, req.Header, c.opts)
 	req = req.WithContext(ctx)
 
-	res, err := c.client.Do(req)
+	res, err := c.do(req, call)
 	if err != nil {
-		setErrorSpan(span, err.Error())
-		span.Finish()
+		// Requests canceled by the caller are told apart from network
+		// failures.
+		setTransportErrorSpan(span, err, c.opts)
+		call.errorCode = transportErrorCode(err)
+		call.finish()
 		return res, err
 	}
 	ext.HTTPStatusCode.Set(span, uint16(res.StatusCode))
@@ -81,26 +149,218 @@ func (c *TraceHTTPClient) Do(req *http.Request) (*http.Response, error) {
 		span.SetTag("error", true)
 	}
 
-	// We want to track when the body is closed, meaning the server is done with
-	// the response.
-	res.Body = closer{
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		call.errorCode = c.responseErrorCode(res)
+	}
+	call.watch(c.opts.maxSpanLifetime)
+
+	return res, nil
+}
+
+// responseErrorCode returns the Twirp error code of a non-2xx response. The
+// body is only decoded if the error is logged on the span or recorded in the
+// metrics, and is left intact for the Twirp client.
+func (c *TraceHTTPClient) responseErrorCode(res *http.Response) twirp.ErrorCode {
+	body := res.Body.(*closer)
+	call := body.call
+	if !c.opts.decodeErrorBodies && call.metrics == nil {
+		return ""
+	}
+
+	// The body is peeked below the closer, so reading it to EOF does not
+	// finish the call.
+	var twerr twirp.Error
+	twerr, body.ReadCloser = peekTwirpError(body.ReadCloser)
+	if twerr == nil {
+		return errorCodeFromStatus(res.StatusCode)
+	}
+
+	if c.opts.decodeErrorBodies && call.span != nil {
+		logTwirpError(call.span, twerr, c.opts)
+	}
+	return twerr.Code()
+}
+
+// do sends the request and tracks the response body so the call is finished
+// when the body is closed.
+func (c *TraceHTTPClient) do(req *http.Request, call *clientCall) (*http.Response, error) {
+	if c.opts.payloadSizes && call.span != nil {
+		// Copy the request so the caller's body is left untouched.
+		req = req.WithContext(req.Context())
+		call.sizes = countClientRequest(req)
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return res, err
+	}
+
+	if call.sizes != nil {
+		call.sizes.countClientResponse(res)
+	}
+
+	// We want to track when the body is read to EOF or closed, meaning the client
+	// is done with the response.
+	res.Body = &closer{
 		ReadCloser: res.Body,
-		span:       span,
+		call:       call,
 	}
 	return res, nil
 }
 
+// clientCall tracks an outgoing request until its response body is closed.
+type clientCall struct {
+	ctx   context.Context
+	start time.Time
+
+	// span is the span of the call, if it is traced. It is only finished by
+	// the call if finishSpan is set, otherwise the client hooks finish it.
+	span       opentracing.Span
+	finishSpan bool
+	sizes      *payloadSizes
+
+	metrics   MetricsSink
+	errorCode twirp.ErrorCode
+
+	// err is the error the response body failed to be read with, if any.
+	err error
+
+	once  sync.Once
+	timer *time.Timer
+}
+
+// watch force-finishes the call if it is still running once maxLifetime has
+// passed since it started.
+func (c *clientCall) watch(maxLifetime time.Duration) {
+	if maxLifetime <= 0 {
+		return
+	}
+	c.timer = time.AfterFunc(maxLifetime-time.Since(c.start), func() {
+		c.once.Do(func() {
+			if c.finishSpan {
+				c.span.SetTag("span.leaked", true)
+			}
+			c.record()
+		})
+	})
+}
+
+// finish records the call once, when its response body is read to EOF or
+// closed.
+func (c *clientCall) finish() {
+	c.end(nil)
+}
+
+// end records the call once, with the error its response body failed to be
+// read with, if any.
+func (c *clientCall) end(err error) {
+	c.once.Do(func() {
+		if c.timer != nil {
+			c.timer.Stop()
+		}
+		c.err = err
+		c.record()
+	})
+}
+
+func (c *clientCall) record() {
+	if c.sizes != nil {
+		c.sizes.setTags(c.span)
+	}
+	if c.metrics != nil {
+		c.metrics.ObserveCall(newCallMetrics(c.ctx, ClientCall, c.start, c.errorCode))
+	}
+	if c.finishSpan {
+		tagContextErr(c.ctx, c.span, c.err)
+		c.span.Finish()
+	}
+}
+
+// maxErrorBodySize limits how much of an error response body is read when
+// decoding the Twirp error it contains.
+const maxErrorBodySize = 1 << 16
+
+// twirpErrorJSON is the JSON envelope Twirp servers use for error responses.
+type twirpErrorJSON struct {
+	Code string            `json:"code"`
+	Msg  string            `json:"msg"`
+	Meta map[string]string `json:"meta,omitempty"`
+}
+
+// peekTwirpError decodes the Twirp error in body, if there is one, and returns
+// a body that still yields every byte of the original response.
+func peekTwirpError(body io.ReadCloser) (twirp.Error, io.ReadCloser) {
+	buf, _ := ioutil.ReadAll(io.LimitReader(body, maxErrorBodySize))
+	body = readCloser{
+		Reader: io.MultiReader(bytes.NewReader(buf), body),
+		Closer: body,
+	}
+
+	var tj twirpErrorJSON
+	if err := json.Unmarshal(buf, &tj); err != nil || tj.Code == "" {
+		return nil, body
+	}
+
+	code := twirp.ErrorCode(tj.Code)
+	if !twirp.IsValidErrorCode(code) {
+		return nil, body
+	}
+
+	twerr := twirp.NewError(code, tj.Msg)
+	for key, value := range tj.Meta {
+		twerr = twerr.WithMeta(key, value)
+	}
+	return twerr, body
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
 type closer struct {
 	io.ReadCloser
-	span opentracing.Span
+	call *clientCall
+}
+
+func (c *closer) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	switch {
+	case err == io.EOF:
+		c.call.finish()
+	case err != nil:
+		c.call.end(err)
+	}
+	return n, err
 }
 
-func (c closer) Close() error {
+func (c *closer) Close() error {
 	err := c.ReadCloser.Close()
-	c.span.Finish()
+	c.call.finish()
 	return err
 }
 
+// injectSpanCtx injects the span context into the outgoing request headers
+// with the tracer of the span, logging a failure on the span itself and
+// reporting it to the error handler.
+func injectSpanCtx(ctx context.Context, span opentracing.Span, header http.Header, opts *TraceOptions) {
+	err := injectWith(opts.propagatorsOrDefault(), span.Tracer(), span.Context(), header)
+	if err != nil {
+		span.LogFields(otlog.String("event", "tracer.Inject() failed"), otlog.Error(err))
+		opts.handlePropagationError(ctx, ClientCall, InjectOperation, err)
+	}
+}
+
+// injectParentSpanCtx injects the context of the span in ctx, if any, so calls
+// that are not traced themselves keep the trace connected.
+func injectParentSpanCtx(ctx context.Context, header http.Header, opts *TraceOptions) {
+	if parent := opentracing.SpanFromContext(ctx); parent != nil {
+		if err := injectWith(opts.propagatorsOrDefault(), parent.Tracer(), parent.Context(), header); err != nil {
+			opts.handlePropagationError(ctx, ClientCall, InjectOperation, err)
+		}
+	}
+}
+
 func setErrorSpan(span opentracing.Span, errorMessage string) {
 	span.SetTag("error", true)
 	span.LogFields(otlog.String("event", "error"), otlog.String("message", errorMessage))
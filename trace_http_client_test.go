@@ -4,12 +4,18 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/mocktracer"
 	"github.com/stretchr/testify/assert"
 	"github.com/twirp-ecosystem/twirptest"
 	"github.com/twitchtv/twirp"
@@ -33,6 +39,7 @@ func TestTraceHTTPClient(t *testing.T) {
 					"http.status_code": uint16(200),
 					"http.url":         fmt.Sprintf("%s/twirp/twirptest.Haberdasher/MakeHat", server.URL),
 					"http.method":      "POST",
+					"twirp.encoding":   "protobuf",
 				}
 			},
 		},
@@ -47,6 +54,7 @@ func TestTraceHTTPClient(t *testing.T) {
 					"http.status_code": uint16(500),
 					"http.url":         fmt.Sprintf("%s/twirp/twirptest.Haberdasher/MakeHat", server.URL),
 					"http.method":      "POST",
+					"twirp.encoding":   "protobuf",
 				}
 			},
 		},
@@ -61,6 +69,7 @@ func TestTraceHTTPClient(t *testing.T) {
 					"http.status_code": uint16(404),
 					"http.url":         fmt.Sprintf("%s/twirp/twirptest.Haberdasher/MakeHat", server.URL),
 					"http.method":      "POST",
+					"twirp.encoding":   "protobuf",
 				}
 			},
 		},
@@ -68,6 +77,7 @@ func TestTraceHTTPClient(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.desc, func(t *testing.T) {
+			global := setupGlobalMockTracer(t)
 			tracer := setupMockTracer()
 			hooks := NewOpenTracingHooks(tracer)
 			server, client := TraceServerAndTraceClient(tt.service, hooks, tracer, tt.clientOpts...)
@@ -87,6 +97,300 @@ func TestTraceHTTPClient(t *testing.T) {
 			assert.Equal(t, tt.expectedTags(server), clientSpan.Tags(), "expected tags to match")
 			assert.Equal(t, serverSpan.SpanContext.TraceID, clientSpan.SpanContext.TraceID, "expected trace to propagate properly")
 			assert.Equal(t, serverSpan.ParentID, clientSpan.SpanContext.SpanID, "expected span to propagate properly")
+			assert.Empty(t, global.FinishedSpans(), "expected no spans on the global tracer")
+		})
+	}
+}
+
+func TestTraceHTTPClientTags(t *testing.T) {
+	type regionKey struct{}
+
+	tracer := setupMockTracer()
+	hooks := NewOpenTracingHooks(tracer)
+	server, client := TraceServerAndTraceClient(twirptest.NoopHatmaker(), hooks, tracer,
+		WithTags(TraceTag{"region", "us-west-2"}),
+		WithTags(TraceTag{"build", "abc123"}),
+		WithContextTags(func(ctx context.Context) []TraceTag {
+			method, _ := twirp.MethodName(ctx)
+			return []TraceTag{
+				{"region", ctx.Value(regionKey{})},
+				{"rpc.method", method},
+			}
+		}),
+	)
+	defer server.Close()
+
+	ctx := context.WithValue(context.Background(), regionKey{}, "eu-central-1")
+	_, err := client.MakeHat(ctx, &twirptest.Size{})
+	if err != nil {
+		t.Fatalf("twirptest client err=%q", err)
+	}
+
+	clientSpan := tracer.FinishedSpans()[1]
+	assert.Equal(t, "abc123", clientSpan.Tag("build"), "expected repeated WithTags to accumulate")
+	assert.Equal(t, "eu-central-1", clientSpan.Tag("region"), "expected context tags to override static tags")
+	assert.Equal(t, "MakeHat", clientSpan.Tag("rpc.method"), "expected context tags to see the Twirp method")
+}
+
+func TestTraceHTTPClientOperationNameFunc(t *testing.T) {
+	tracer := setupMockTracer()
+	hooks := NewOpenTracingHooks(tracer, WithOperationNameFunc(FullMethodName))
+	server, client := TraceServerAndTraceClient(twirptest.NoopHatmaker(), hooks, tracer, WithOperationNameFunc(FullMethodName))
+	defer server.Close()
+
+	_, err := client.MakeHat(context.Background(), &twirptest.Size{})
+	if err != nil {
+		t.Fatalf("twirptest client err=%q", err)
+	}
+
+	for _, span := range tracer.FinishedSpans() {
+		assert.Equal(t, "twirptest.Haberdasher/MakeHat", span.OperationName, "expected server and client operation names to match")
+	}
+
+	var gotReq *http.Request
+	httpClient := NewTraceHTTPClient(http.DefaultClient, tracer, WithOperationNameFunc(func(packageName, serviceName, methodName string, req *http.Request) string {
+		gotReq = req
+		return FullMethodName(packageName, serviceName, methodName, req)
+	}))
+	req, _ := http.NewRequest("GET", server.URL+"/healthz", nil)
+	res, err := httpClient.Do(req)
+	if err != nil {
+		t.Fatalf("http client err=%q", err)
+	}
+	res.Body.Close()
+
+	assert.Equal(t, req, gotReq, "expected the request to be passed to the function")
+	spans := tracer.FinishedSpans()
+	assert.Equal(t, "/healthz", spans[len(spans)-1].OperationName, "expected non-Twirp requests to be named after the path")
+}
+
+func TestTraceHTTPClientDecodesErrorResponses(t *testing.T) {
+	tracer := setupMockTracer()
+	hooks := NewOpenTracingHooks(tracer)
+	service := twirptest.ErroringHatmaker(twirp.InvalidArgumentError("Inches", "is too big"))
+	server, client := TraceServerAndTraceClient(service, hooks, tracer, DecodeErrorResponses(true))
+	defer server.Close()
+
+	_, err := client.MakeHat(context.Background(), &twirptest.Size{})
+	twerr, ok := err.(twirp.Error)
+	if !assert.True(t, ok, "expected a twirp.Error") {
+		return
+	}
+	assert.Equal(t, twirp.InvalidArgument, twerr.Code(), "expected the client to still decode the error")
+	assert.Equal(t, "Inches", twerr.Meta("argument"), "expected the client to still decode the error")
+
+	clientSpan := tracer.FinishedSpans()[1]
+	assert.Equal(t, map[string]interface{}{
+		"span.kind":        ext.SpanKindEnum("client"),
+		"error":            true,
+		"twirp.error_code": "invalid_argument",
+		"http.status_code": uint16(400),
+		"http.url":         fmt.Sprintf("%s/twirp/twirptest.Haberdasher/MakeHat", server.URL),
+		"http.method":      "POST",
+		"twirp.encoding":   "protobuf",
+	}, clientSpan.Tags(), "expected tags to match")
+
+	actualLogs := clientSpan.Logs()
+	zeroOutTimestamps(actualLogs)
+	assert.Equal(t, []mocktracer.MockLogRecord{
+		{
+			Fields: []mocktracer.MockKeyValue{
+				{Key: "event", ValueKind: reflect.String, ValueString: "error"},
+				{Key: "message", ValueKind: reflect.String, ValueString: "Inches is too big"},
+				{Key: "meta.argument", ValueKind: reflect.String, ValueString: "Inches"},
+			},
+		},
+	}, actualLogs)
+}
+
+func TestTraceHTTPClientSpanCompletion(t *testing.T) {
+	body := strings.Repeat("hat", 1024)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, body)
+	}))
+	defer server.Close()
+
+	do := func(t *testing.T, tracer opentracing.Tracer, opts ...TraceOption) *http.Response {
+		client := NewTraceHTTPClient(http.DefaultClient, tracer, opts...)
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("http client err=%q", err)
+		}
+		return res
+	}
+
+	t.Run("finishes the span when the body is read to EOF", func(t *testing.T) {
+		tracer := setupMockTracer()
+		res := do(t, tracer)
+
+		b, err := ioutil.ReadAll(res.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, body, string(b))
+		assert.Len(t, tracer.FinishedSpans(), 1, "expected the span to be finished at EOF")
+
+		res.Body.Close()
+		assert.Len(t, tracer.FinishedSpans(), 1, "expected the span to be finished once")
+	})
+
+	t.Run("finishes the span when the body is closed early", func(t *testing.T) {
+		tracer := setupMockTracer()
+		res := do(t, tracer)
+
+		_, err := res.Body.Read(make([]byte, 16))
+		assert.NoError(t, err)
+		assert.Empty(t, tracer.FinishedSpans(), "expected the span to be running while the body is read")
+
+		res.Body.Close()
+		spans := tracer.FinishedSpans()
+		if assert.Len(t, spans, 1, "expected the span to be finished on close") {
+			assert.Nil(t, spans[0].Tag("span.leaked"), "expected the span not to be tagged as leaked")
+		}
+	})
+
+	t.Run("leaves the span running when the body is never closed", func(t *testing.T) {
+		tracer := setupMockTracer()
+		res := do(t, tracer)
+		defer res.Body.Close()
+
+		time.Sleep(20 * time.Millisecond)
+		assert.Empty(t, tracer.FinishedSpans(), "expected the span to be running without a maximum lifetime")
+	})
+
+	t.Run("force-finishes the span after the maximum lifetime", func(t *testing.T) {
+		tracer := setupMockTracer()
+		res := do(t, tracer, WithMaxSpanLifetime(10*time.Millisecond))
+		defer res.Body.Close()
+
+		assert.Eventually(t, func() bool {
+			return len(tracer.FinishedSpans()) == 1
+		}, time.Second, time.Millisecond, "expected the span to be finished")
+		assert.Equal(t, true, tracer.FinishedSpans()[0].Tag("span.leaked"), "expected the span to be tagged as leaked")
+
+		_, _ = ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Len(t, tracer.FinishedSpans(), 1, "expected the span to be finished once")
+	})
+}
+
+func TestTraceClientHooks(t *testing.T) {
+	tests := []struct {
+		desc            string
+		errExpected     bool
+		service         twirptest.Haberdasher
+		clientOpts      []TraceOption
+		withTraceClient bool
+		expectedTags    func(*httptest.Server) map[string]interface{}
+	}{
+		{
+			desc:        "properly traces valid requests",
+			errExpected: false,
+			service:     twirptest.NoopHatmaker(),
+			expectedTags: func(server *httptest.Server) map[string]interface{} {
+				return map[string]interface{}{
+					"span.kind":      ext.SpanKindEnum("client"),
+					"component":      "twirp",
+					"package":        "twirptest",
+					"service":        "Haberdasher",
+					"method":         "MakeHat",
+					"http.url":       fmt.Sprintf("%s/twirp/twirptest.Haberdasher/MakeHat", server.URL),
+					"http.method":    "POST",
+					"twirp.encoding": "protobuf",
+				}
+			},
+		},
+		{
+			desc:        "properly sets metadata for errors",
+			errExpected: true,
+			service:     twirptest.ErroringHatmaker(errors.New("test")),
+			expectedTags: func(server *httptest.Server) map[string]interface{} {
+				return map[string]interface{}{
+					"span.kind":        ext.SpanKindEnum("client"),
+					"component":        "twirp",
+					"package":          "twirptest",
+					"service":          "Haberdasher",
+					"method":           "MakeHat",
+					"error":            true,
+					"twirp.error_code": "internal",
+					"http.url":         fmt.Sprintf("%s/twirp/twirptest.Haberdasher/MakeHat", server.URL),
+					"http.method":      "POST",
+					"twirp.encoding":   "protobuf",
+				}
+			},
+		},
+		{
+			desc:        "does not report client errors in span if correct option is set",
+			errExpected: true,
+			service:     twirptest.ErroringHatmaker(twirp.NotFoundError("not found")),
+			clientOpts:  []TraceOption{IncludeClientErrors(false)},
+			expectedTags: func(server *httptest.Server) map[string]interface{} {
+				return map[string]interface{}{
+					"span.kind":        ext.SpanKindEnum("client"),
+					"component":        "twirp",
+					"package":          "twirptest",
+					"service":          "Haberdasher",
+					"method":           "MakeHat",
+					"twirp.error_code": "not_found",
+					"http.url":         fmt.Sprintf("%s/twirp/twirptest.Haberdasher/MakeHat", server.URL),
+					"http.method":      "POST",
+					"twirp.encoding":   "protobuf",
+				}
+			},
+		},
+		{
+			desc:            "reuses the hook span when combined with TraceHTTPClient",
+			errExpected:     false,
+			service:         twirptest.NoopHatmaker(),
+			withTraceClient: true,
+			expectedTags: func(server *httptest.Server) map[string]interface{} {
+				return map[string]interface{}{
+					"span.kind":      ext.SpanKindEnum("client"),
+					"component":      "twirp",
+					"package":        "twirptest",
+					"service":        "Haberdasher",
+					"method":         "MakeHat",
+					"http.url":       fmt.Sprintf("%s/twirp/twirptest.Haberdasher/MakeHat", server.URL),
+					"http.method":    "POST",
+					"twirp.encoding": "protobuf",
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			global := setupGlobalMockTracer(t)
+			tracer := setupMockTracer()
+			hooks := NewOpenTracingHooks(tracer)
+			clientHooks := NewOpenTracingClientHooks(tracer, tt.clientOpts...)
+
+			var httpClient HTTPClient = http.DefaultClient
+			if tt.withTraceClient {
+				httpClient = NewTraceHTTPClient(httpClient, tracer, tt.clientOpts...)
+			}
+			server := httptest.NewServer(WithTraceContext(twirptest.NewHaberdasherServer(tt.service, hooks), tracer))
+			defer server.Close()
+			client := hookedHaberdasherClient(server.URL, httpClient, clientHooks)
+
+			_, err := client.MakeHat(context.Background(), &twirptest.Size{})
+			if err != nil {
+				if !tt.errExpected {
+					t.Fatalf("twirptest client err=%q", err)
+				} else {
+					assert.Error(t, err, "expected an error")
+				}
+			}
+			spans := tracer.FinishedSpans()
+			if !assert.Len(t, spans, 2, "expected exactly one server and one client span") {
+				return
+			}
+			clientSpan := spans[1]
+			serverSpan := spans[0]
+			assert.Equal(t, clientSpan.OperationName, "MakeHat", "expected operation name to be MakeHat")
+			assert.Equal(t, tt.expectedTags(server), clientSpan.Tags(), "expected tags to match")
+			assert.Equal(t, serverSpan.SpanContext.TraceID, clientSpan.SpanContext.TraceID, "expected trace to propagate properly")
+			assert.Equal(t, serverSpan.ParentID, clientSpan.SpanContext.SpanID, "expected span to propagate properly")
+			assert.Empty(t, global.FinishedSpans(), "expected no spans on the global tracer")
 		})
 	}
 }
@@ -96,3 +400,58 @@ func TraceServerAndTraceClient(h twirptest.Haberdasher, hooks *twirp.ServerHooks
 	c := twirptest.NewHaberdasherProtobufClient(s.URL, NewTraceHTTPClient(http.DefaultClient, tracer, opts...))
 	return s, c
 }
+
+// hookedHaberdasherClient returns a twirptest client that drives
+// twirp.ClientHooks the same way clients generated by protoc-gen-twirp v8 do:
+// RequestPrepared before the request is sent, then either Error or
+// ResponseReceived once the call has completed.
+func hookedHaberdasherClient(url string, client HTTPClient, hooks *twirp.ClientHooks) twirptest.Haberdasher {
+	return &hookedHaberdasher{
+		client: twirptest.NewHaberdasherProtobufClient(url, hookedHTTPClient{client: client, hooks: hooks}),
+		hooks:  hooks,
+	}
+}
+
+type hookedCallKey struct{}
+
+type hookedCall struct {
+	ctx context.Context
+}
+
+type hookedHaberdasher struct {
+	client twirptest.Haberdasher
+	hooks  *twirp.ClientHooks
+}
+
+func (h *hookedHaberdasher) MakeHat(ctx context.Context, in *twirptest.Size) (*twirptest.Hat, error) {
+	call := &hookedCall{ctx: ctx}
+	hat, err := h.client.MakeHat(context.WithValue(ctx, hookedCallKey{}, call), in)
+	if err != nil {
+		twerr, ok := err.(twirp.Error)
+		if !ok {
+			twerr = twirp.InternalErrorWith(err)
+		}
+		h.hooks.Error(call.ctx, twerr)
+		return nil, err
+	}
+
+	h.hooks.ResponseReceived(call.ctx)
+	return hat, nil
+}
+
+type hookedHTTPClient struct {
+	client HTTPClient
+	hooks  *twirp.ClientHooks
+}
+
+func (c hookedHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	ctx, err := c.hooks.RequestPrepared(req.Context(), req)
+	if err != nil {
+		return nil, err
+	}
+	if call, ok := ctx.Value(hookedCallKey{}).(*hookedCall); ok {
+		call.ctx = ctx
+	}
+
+	return c.client.Do(req.WithContext(ctx))
+}
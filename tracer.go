@@ -0,0 +1,53 @@
+package ottwirp
+
+import (
+	"context"
+	"net/http"
+
+	ot "github.com/opentracing/opentracing-go"
+)
+
+// TracerFunc picks the tracer of a server call from its context, such as the
+// tracer of the tenant the request is for.
+type TracerFunc func(ctx context.Context) ot.Tracer
+
+// WithTracerFunc makes the server hooks pick the tracer of each call with fn,
+// which is called with the context of the RequestReceived hook, or of the
+// RequestRouted hook when filters are set. The span context of the request is
+// extracted and the server span started with the chosen tracer. If fn returns
+// nil, the tracer given to NewOpenTracingHooks is used.
+func WithTracerFunc(fn TracerFunc) TraceOption {
+	return func(opts *TraceOptions) {
+		opts.tracerFn = fn
+	}
+}
+
+// WithRequestTracer makes TraceHTTPClient, RetryingHTTPClient and the client
+// hooks pick the tracer of each call from its request with fn. The client span
+// is started and its span context injected with the chosen tracer. If fn
+// returns nil, the tracer given to the constructor is used.
+func WithRequestTracer(fn func(req *http.Request) ot.Tracer) TraceOption {
+	return func(opts *TraceOptions) {
+		opts.requestTracerFn = fn
+	}
+}
+
+// serverTracer returns the tracer of the server call in ctx.
+func (opts *TraceOptions) serverTracer(ctx context.Context, tracer ot.Tracer) ot.Tracer {
+	if opts.tracerFn != nil {
+		if t := opts.tracerFn(ctx); t != nil {
+			return t
+		}
+	}
+	return tracer
+}
+
+// clientTracer returns the tracer of the client call sending req.
+func (opts *TraceOptions) clientTracer(req *http.Request, tracer ot.Tracer) ot.Tracer {
+	if opts.requestTracerFn != nil {
+		if t := opts.requestTracerFn(req); t != nil {
+			return t
+		}
+	}
+	return tracer
+}
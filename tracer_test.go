@@ -0,0 +1,68 @@
+package ottwirp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/stretchr/testify/assert"
+	"github.com/twirp-ecosystem/twirptest"
+	"github.com/twitchtv/twirp"
+)
+
+func TestPerRequestTracers(t *testing.T) {
+	fallback := setupMockTracer()
+	tenants := map[string]*mocktracer.MockTracer{
+		"a": setupMockTracer(),
+		"b": setupMockTracer(),
+	}
+
+	hooks := NewOpenTracingHooks(fallback, WithLifecyclePhases(LifecycleSpans), WithTracerFunc(func(ctx context.Context) opentracing.Tracer {
+		tenant, _ := ctx.Value(tenantKey{}).(string)
+		if tracer, ok := tenants[tenant]; ok {
+			return tracer
+		}
+		return nil
+	}))
+	handler := WithTraceContext(twirptest.NewHaberdasherServer(twirptest.NoopHatmaker(), hooks), fallback)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), tenantKey{}, r.Header.Get("X-Tenant"))
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	}))
+	defer server.Close()
+
+	httpClient := NewTraceHTTPClient(http.DefaultClient, fallback, WithRequestTracer(func(req *http.Request) opentracing.Tracer {
+		if tracer, ok := tenants[req.Header.Get("X-Tenant")]; ok {
+			return tracer
+		}
+		return nil
+	}))
+
+	for tenant, tracer := range tenants {
+		header := http.Header{}
+		header.Set("X-Tenant", tenant)
+		ctx, err := twirp.WithHTTPRequestHeaders(context.Background(), header)
+		if err != nil {
+			t.Fatalf("twirp.WithHTTPRequestHeaders err=%q", err)
+		}
+		client := twirptest.NewHaberdasherProtobufClient(server.URL, httpClient)
+		_, err = client.MakeHat(ctx, &twirptest.Size{})
+		assert.NoError(t, err)
+
+		spans := tracer.FinishedSpans()
+		// The routing, handler and response phases, then the server and
+		// client spans.
+		if !assert.Len(t, spans, 5, "expected the spans of tenant %s on its tracer", tenant) {
+			continue
+		}
+		serverSpan, clientSpan := spans[3], spans[4]
+		assert.Equal(t, clientSpan.SpanContext.SpanID, serverSpan.ParentID, "expected the span context of tenant %s to propagate", tenant)
+		for _, phase := range spans[:3] {
+			assert.Equal(t, serverSpan.SpanContext.SpanID, phase.ParentID, "expected the phases of tenant %s on its tracer", tenant)
+		}
+	}
+	assert.Empty(t, fallback.FinishedSpans(), "expected no spans on the fallback tracer")
+}
@@ -2,33 +2,100 @@ package ottwirp
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/netip"
+	"runtime/debug"
+	"sort"
 	"strconv"
+	"sync"
+	"time"
 
 	ot "github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/ext"
 	otlog "github.com/opentracing/opentracing-go/log"
 	"github.com/twitchtv/twirp"
+	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
 const (
 	RequestReceivedEvent = "request.received"
+
+	// redactedValue replaces the value of redacted twirp.Error metadata.
+	redactedValue = "[REDACTED]"
 )
 
 type tracingInfoKey struct{}
 
-// TODO: Add functional options for things such as filtering or maybe logging
-// custom fields?
+type serverCallKey struct{}
+
+// serverCall tracks a request from the RequestReceived hook onwards.
+type serverCall struct {
+	receivedAt time.Time
+
+	// pending is set while the decision to trace the request waits for the
+	// request to be routed.
+	pending   bool
+	errorCode twirp.ErrorCode
+
+	// phase is the lifecycle phase span in progress, and responding is set
+	// once the response phase has started.
+	phase      ot.Span
+	responding bool
+}
+
+// tracingInfo is attached to the request context by WithTraceContext.
+type tracingInfo struct {
+	header      http.Header
+	propagators []Propagator
+	request     *requestInfo
+
+	// span is the server span started by the hooks. WithTraceContext finishes
+	// it once the wrapped handler has returned, or has panicked, at respondedAt
+	// if the ResponseSent hook ran.
+	span        ot.Span
+	call        *serverCall
+	sizes       *payloadSizes
+	respondedAt time.Time
+}
 
 type TraceServerHooks struct {
 	Tracer ot.Tracer
 	opts   *TraceOptions
+
+	missingTraceContext sync.Once
 }
 
 type TraceOptions struct {
-	includeClientErrors bool
-	tags                []TraceTag
-	ctxTagFn            func(ctx context.Context) []TraceTag
+	includeClientErrors  bool
+	decodeErrorBodies    bool
+	payloadSizes         bool
+	includeErrorCause    bool
+	redactedMetaKeys     map[string]bool
+	tags                 []TraceTag
+	ctxTagFn             func(ctx context.Context) []TraceTag
+	filters              []func(ctx context.Context) bool
+	allowMethods         []MethodRule
+	denyMethods          []MethodRule
+	operationNameFn      OperationNameFunc
+	propagators          []Propagator
+	metrics              MetricsSink
+	lifecyclePhases      LifecyclePhases
+	maxSpanLifetime      time.Duration
+	baggageTags          []string
+	ctxBaggageFn         func(ctx context.Context) []BaggageItem
+	baggageLimits        *BaggageLimits
+	messageMethods       []MethodRule
+	maxMessageSize       int
+	fieldRedactors       []func(field protoreflect.FieldDescriptor) bool
+	includeCancellations bool
+	retryPolicy          RetryPolicy
+	trustProxies         bool
+	trustedProxies       []netip.Prefix
+	errorHandler         func(ctx context.Context, err error)
+	tracerFn             TracerFunc
+	requestTracerFn      func(req *http.Request) ot.Tracer
 }
 
 // TraceTag represents a single span tag.
@@ -43,6 +110,35 @@ type TraceTag struct {
 
 type TraceOption func(opts *TraceOptions)
 
+// OperationNameFunc returns the operation name of the span for a call to a
+// Twirp method. On the client, req is the outgoing request and the names are
+// empty if the request context does not hold them. On the server, req is nil.
+type OperationNameFunc func(packageName, serviceName, methodName string, req *http.Request) string
+
+// FullMethodName is an OperationNameFunc that names spans after the fully
+// qualified Twirp method, as in "twirptest.Haberdasher/MakeHat". It falls back
+// to the URL path for client requests without a method name.
+func FullMethodName(packageName, serviceName, methodName string, req *http.Request) string {
+	if methodName == "" && req != nil {
+		return req.URL.Path
+	}
+
+	service := serviceName
+	if packageName != "" {
+		service = packageName + "." + serviceName
+	}
+	return service + "/" + methodName
+}
+
+// WithOperationNameFunc defines the function used to name server and client
+// spans. By default spans are named after the Twirp method, and client spans
+// fall back to the URL path.
+func WithOperationNameFunc(fn OperationNameFunc) TraceOption {
+	return func(opts *TraceOptions) {
+		opts.operationNameFn = fn
+	}
+}
+
 // IncludeClientErrors, if set, will report client errors (4xx) as errors in the server span.
 // If not set, only 5xx status will be reported as erroneous.
 func IncludeClientErrors(includeClientErrors bool) TraceOption {
@@ -51,29 +147,90 @@ func IncludeClientErrors(includeClientErrors bool) TraceOption {
 	}
 }
 
+// DecodeErrorResponses, if set, makes TraceHTTPClient peek at the body of
+// non-2xx responses and record the Twirp error code, message and metadata on
+// the client span, the same way the server hooks do. The body is left intact
+// for the Twirp client.
+func DecodeErrorResponses(decodeErrorBodies bool) TraceOption {
+	return func(opts *TraceOptions) {
+		opts.decodeErrorBodies = decodeErrorBodies
+	}
+}
+
+// IncludePayloadSizes, if set, tags spans with the number of request and
+// response body bytes on the wire as rpc.request.size and rpc.response.size,
+// and with the uncompressed sizes as rpc.request.uncompressed_size and
+// rpc.response.uncompressed_size for gzip encoded bodies. On the server side
+// the option must be passed to WithTraceContext.
+func IncludePayloadSizes(includePayloadSizes bool) TraceOption {
+	return func(opts *TraceOptions) {
+		opts.payloadSizes = includePayloadSizes
+	}
+}
+
+// IncludeErrorCause, if set, will log the error wrapped by a twirp.Error (for
+// example the original error of an internal error) on the span.
+func IncludeErrorCause(includeErrorCause bool) TraceOption {
+	return func(opts *TraceOptions) {
+		opts.includeErrorCause = includeErrorCause
+	}
+}
+
+// WithRedactedMetaKeys defines twirp.Error metadata keys whose values are
+// replaced with a placeholder when the metadata is logged on the span.
+func WithRedactedMetaKeys(keys ...string) TraceOption {
+	return func(opts *TraceOptions) {
+		if opts.redactedMetaKeys == nil {
+			opts.redactedMetaKeys = make(map[string]bool, len(keys))
+		}
+		for _, key := range keys {
+			opts.redactedMetaKeys[key] = true
+		}
+	}
+}
+
 // WithTags defines tags to be added to each outoing span by default.  If there
-// is a pre-existing tag set for `key`, it is overwritten.
+// is a pre-existing tag set for `key`, it is overwritten. Calling WithTags
+// multiple times adds to the tags.
 func WithTags(tags ...TraceTag) TraceOption {
 	return func(opts *TraceOptions) {
-		opts.tags = tags
+		opts.tags = append(opts.tags, tags...)
 	}
 }
 
 // WithContextTags defines a function that returns set of trace tags. This is
 // useful to extract values from the request ctx and return a set of tags that
 // are set on the span. The function is used during the `RequestReceived`
-// server hook.
+// server hook, and when TraceHTTPClient or the client hooks start a span.
 func WithContextTags(fn func(ctx context.Context) []TraceTag) TraceOption {
 	return func(opts *TraceOptions) {
 		opts.ctxTagFn = fn
 	}
 }
 
+// operationName returns the operation name for the call in ctx. req is the
+// outgoing request on the client, and nil on the server.
+func (opts *TraceOptions) operationName(ctx context.Context, req *http.Request) string {
+	packageName, _ := twirp.PackageName(ctx)
+	serviceName, _ := twirp.ServiceName(ctx)
+	methodName, _ := twirp.MethodName(ctx)
+	if opts.operationNameFn != nil {
+		return opts.operationNameFn(packageName, serviceName, methodName, req)
+	}
+
+	if methodName == "" && req != nil {
+		// No method name, let's use the URL path instead then.
+		return req.URL.Path
+	}
+	return methodName
+}
+
 // NewOpenTracingHooks provides a twirp.ServerHooks struct which records
 // OpenTracing spans.
 func NewOpenTracingHooks(tracer ot.Tracer, opts ...TraceOption) *twirp.ServerHooks {
 	serverOpts := &TraceOptions{
-		includeClientErrors: true,
+		includeClientErrors:  true,
+		includeCancellations: true,
 	}
 
 	for _, opt := range opts {
@@ -90,22 +247,58 @@ func NewOpenTracingHooks(tracer ot.Tracer, opts ...TraceOption) *twirp.ServerHoo
 
 func (t *TraceServerHooks) TwirpHooks() *twirp.ServerHooks {
 	return &twirp.ServerHooks{
-		RequestReceived: t.startTraceSpan,
-		RequestRouted:   t.handleRequestRouted,
-		ResponseSent:    t.finishTrace,
-		Error:           t.handleError,
+		RequestReceived:  t.startTraceSpan,
+		RequestRouted:    t.handleRequestRouted,
+		ResponsePrepared: t.handleResponsePrepared,
+		ResponseSent:     t.finishTrace,
+		Error:            t.handleError,
 	}
 }
 
 func (t *TraceServerHooks) startTraceSpan(ctx context.Context) (context.Context, error) {
-	spanContext, err := extractSpanCtx(ctx, t.Tracer)
-	if err != nil && err != ot.ErrSpanContextNotFound { // nolint: megacheck, staticcheck
-		// TODO: We need to do error reporting here. The tracer implementation
-		// will have to do something because we don't know where this error will
-		// live.
-	}
-	// Create the initial span, it won't have a method name just yet.
-	span, ctx := ot.StartSpanFromContext(ctx, RequestReceivedEvent, ext.RPCServerOption(spanContext), ext.SpanKindRPCServer)
+	t.checkTraceContext(ctx)
+
+	call := &serverCall{
+		receivedAt: time.Now(),
+		// The filters may depend on the method name, which is only known once the
+		// request is routed.
+		pending: t.opts.hasFilters(),
+	}
+	ctx = context.WithValue(ctx, serverCallKey{}, call)
+	if call.pending {
+		return ctx, nil
+	}
+
+	return t.startSpan(ctx, RequestReceivedEvent, call.receivedAt), nil
+}
+
+// startPendingSpan starts the span deferred by startTraceSpan, if the request
+// passes the filters.
+func (t *TraceServerHooks) startPendingSpan(ctx context.Context) context.Context {
+	call := serverCallFromContext(ctx)
+	if call == nil || !call.pending {
+		return ctx
+	}
+	call.pending = false
+	if !t.opts.shouldTrace(ctx) {
+		return ctx
+	}
+
+	operationName := RequestReceivedEvent
+	if _, ok := twirp.MethodName(ctx); ok {
+		operationName = t.opts.operationName(ctx, nil)
+	}
+	return t.startSpan(ctx, operationName, call.receivedAt)
+}
+
+func (t *TraceServerHooks) startSpan(ctx context.Context, operationName string, startTime time.Time) context.Context {
+	tracer := t.opts.serverTracer(ctx, t.Tracer)
+	spanContext, baggageTruncated, err := t.extractSpanCtx(ctx, tracer)
+	if err == ot.ErrSpanContextNotFound {
+		err = nil
+	}
+	// Create the initial span, it may not have a method name just yet.
+	span, ctx := ot.StartSpanFromContextWithTracer(ctx, tracer, operationName, ext.RPCServerOption(spanContext), ext.SpanKindRPCServer, ot.StartTime(startTime))
 	if span != nil {
 		span.SetTag("component", "twirp")
 
@@ -128,25 +321,57 @@ func (t *TraceServerHooks) startTraceSpan(ctx context.Context) (context.Context,
 				span.SetTag(tag.Key, tag.Value)
 			}
 		}
+
+		t.opts.setBaggageTags(span)
+		if baggageTruncated {
+			span.SetTag("baggage.truncated", true)
+		}
+		if err != nil {
+			span.SetTag("trace.extract_error", err.Error())
+		}
+		tagDeadline(ctx, span)
+
+		if info := tracingInfoFromContext(ctx); info != nil {
+			info.request.setTags(span)
+			setEncodingTag(ctx, span)
+			info.span = span
+			info.call = serverCallFromContext(ctx)
+			if info.sizes != nil {
+				info.sizes.trace(info.header)
+			}
+		}
 	}
 
-	return ctx, nil
+	if err != nil {
+		// The span started a new trace, as the inbound span context is
+		// malformed.
+		t.opts.handlePropagationError(ctx, ServerCall, ExtractOperation, err)
+	}
+
+	return ctx
 }
 
 // handleRequestRouted sets the operation name because we won't know what it is
 // until the RequestRouted hook.
 func (t *TraceServerHooks) handleRequestRouted(ctx context.Context) (context.Context, error) {
+	ctx = t.startPendingSpan(ctx)
 	span := ot.SpanFromContext(ctx)
 	if span != nil {
-		if method, ok := twirp.MethodName(ctx); ok {
-			span.SetOperationName(method)
+		if _, ok := twirp.MethodName(ctx); ok {
+			span.SetOperationName(t.opts.operationName(ctx, nil))
 		}
 	}
+	t.startHandlerPhase(ctx)
 
 	return ctx, nil
 }
 
 func (t *TraceServerHooks) finishTrace(ctx context.Context) {
+	if call := serverCallFromContext(ctx); call != nil && t.opts.metrics != nil {
+		t.opts.metrics.ObserveCall(newCallMetrics(ctx, ServerCall, call.receivedAt, call.errorCode))
+	}
+	t.finishPhases(ctx)
+
 	span := ot.SpanFromContext(ctx)
 	if span != nil {
 		status, haveStatus := twirp.StatusCode(ctx)
@@ -157,37 +382,167 @@ func (t *TraceServerHooks) finishTrace(ctx context.Context) {
 			span.SetTag("http.status_code", code)
 		}
 
+		// Spans started within WithTraceContext end now, but are finished by
+		// it, once the payload sizes are known and a panic of the handler is
+		// logged.
+		if info := tracingInfoFromContext(ctx); info != nil && info.span == span {
+			info.respondedAt = time.Now()
+			return
+		}
 		span.Finish()
 	}
 }
 
 func (t *TraceServerHooks) handleError(ctx context.Context, err twirp.Error) context.Context {
+	// Requests that fail before being routed still get a span if they pass the
+	// filters.
+	ctx = t.startPendingSpan(ctx)
+	if call := serverCallFromContext(ctx); call != nil {
+		call.errorCode = err.Code()
+	}
+
 	span := ot.SpanFromContext(ctx)
-	statusCode := twirp.ServerHTTPStatusFromErrorCode(err.Code())
 	if span != nil {
-		if t.opts.includeClientErrors || statusCode >= 500 {
-			span.SetTag("error", true)
-		}
-		span.LogFields(otlog.String("event", "error"), otlog.String("message", err.Msg()))
+		setTwirpErrorSpan(ctx, span, err, t.opts)
 	}
+	// The error is logged on the span already, so no event is logged for the
+	// response phase.
+	t.startResponsePhase(ctx, "")
 
 	return ctx
 }
 
+// setTwirpErrorSpan marks the span as erroneous unless err is a client error
+// or a cancellation that should not be reported, and records err with
+// logTwirpError.
+func setTwirpErrorSpan(ctx context.Context, span ot.Span, err twirp.Error, opts *TraceOptions) {
+	tagContextErr(ctx, span, err)
+	canceled := isCanceled(ctx, err)
+
+	statusCode := twirp.ServerHTTPStatusFromErrorCode(err.Code())
+	if (opts.includeClientErrors || statusCode >= 500) && (opts.includeCancellations || !canceled) {
+		span.SetTag("error", true)
+	}
+	logTwirpError(span, err, opts)
+}
+
+// logTwirpError tags the span with the Twirp error code and logs the error
+// message, metadata and, if enabled, the wrapped cause.
+func logTwirpError(span ot.Span, err twirp.Error, opts *TraceOptions) {
+	span.SetTag("twirp.error_code", string(err.Code()))
+
+	fields := []otlog.Field{otlog.String("event", "error"), otlog.String("message", err.Msg())}
+
+	meta := err.MetaMap()
+	keys := make([]string, 0, len(meta))
+	for key := range meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := meta[key]
+		if opts.redactedMetaKeys[key] {
+			value = redactedValue
+		}
+		fields = append(fields, otlog.String("meta."+key, value))
+	}
+
+	if opts.includeErrorCause {
+		if cause := errors.Unwrap(err); cause != nil {
+			fields = append(fields, otlog.String("error.kind", fmt.Sprintf("%T", cause)), otlog.Object("error.object", cause))
+		}
+	}
+
+	span.LogFields(fields...)
+}
+
 // WithTraceContext wraps the handler and extracts the span context from request
-// headers to attach to the context for connecting client and server calls.
-func WithTraceContext(base http.Handler, tracer ot.Tracer) http.Handler {
+// headers to attach to the context for connecting client and server calls. It
+// also captures the HTTP method, path, user agent and peer address of the
+// request, which the hooks set as tags on the server span.
+//
+// The server span is finished even if the handler panics, in which case it is
+// marked as erroneous and the panic value and stack trace are logged on it
+// before the panic is propagated.
+func WithTraceContext(base http.Handler, tracer ot.Tracer, opts ...TraceOption) http.Handler {
+	serverOpts := &TraceOptions{}
+	for _, opt := range opts {
+		opt(serverOpts)
+	}
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx := r.Context()
-		carrier := ot.HTTPHeadersCarrier(r.Header)
-		ctx = context.WithValue(ctx, tracingInfoKey{}, carrier)
-		r = r.WithContext(ctx)
+		info := &tracingInfo{
+			header:      r.Header,
+			propagators: serverOpts.propagatorsOrDefault(),
+			request:     newRequestInfo(r, serverOpts),
+		}
+		if serverOpts.payloadSizes {
+			w, r, info.sizes = countServerPayloads(w, r)
+			defer info.sizes.close()
+		}
+		ctx := context.WithValue(r.Context(), tracingInfoKey{}, info)
+		r = r.WithContext(withEncoding(ctx, r.Header))
 
+		defer func() {
+			if p := recover(); p != nil {
+				info.finishSpan(p)
+				panic(p)
+			}
+		}()
 		base.ServeHTTP(w, r)
+		info.finishSpan(nil)
 	})
 }
 
-func extractSpanCtx(ctx context.Context, tracer ot.Tracer) (ot.SpanContext, error) {
-	carrier := ctx.Value(tracingInfoKey{})
-	return tracer.Extract(ot.HTTPHeaders, carrier)
+// finishSpan finishes the server span, if any. If the handler panicked, the
+// span is marked as erroneous and the panic value and stack are logged on it.
+func (info *tracingInfo) finishSpan(panicValue interface{}) {
+	if info.span == nil {
+		return
+	}
+
+	if panicValue != nil {
+		ext.Error.Set(info.span, true)
+		info.span.LogFields(
+			otlog.String("event", "panic"),
+			otlog.String("message", fmt.Sprint(panicValue)),
+			otlog.String("stack", string(debug.Stack())),
+		)
+	}
+	if info.call != nil && info.call.phase != nil {
+		// The ResponseSent hook did not run.
+		info.call.phase.Finish()
+		info.call.phase = nil
+	}
+	if info.sizes != nil {
+		info.sizes.setTags(info.span)
+	}
+	info.span.FinishWithOptions(ot.FinishOptions{FinishTime: info.respondedAt})
+}
+
+func serverCallFromContext(ctx context.Context) *serverCall {
+	call, _ := ctx.Value(serverCallKey{}).(*serverCall)
+	return call
+}
+
+func tracingInfoFromContext(ctx context.Context) *tracingInfo {
+	info, _ := ctx.Value(tracingInfoKey{}).(*tracingInfo)
+	return info
+}
+
+// extractSpanCtx extracts the span context of the request from the headers
+// saved by WithTraceContext, and reports whether inbound baggage was dropped to
+// enforce the WithBaggageLimits limits.
+func (t *TraceServerHooks) extractSpanCtx(ctx context.Context, tracer ot.Tracer) (ot.SpanContext, bool, error) {
+	info := tracingInfoFromContext(ctx)
+	if info == nil {
+		return nil, false, ot.ErrSpanContextNotFound
+	}
+
+	header, truncated := info.header, false
+	if t.opts.baggageLimits != nil {
+		header, truncated = t.opts.baggageLimits.limit(header)
+	}
+	spanContext, err := extractWith(info.propagators, tracer, header)
+	return spanContext, truncated, err
 }
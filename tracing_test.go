@@ -3,6 +3,7 @@ package ottwirp
 import (
 	"context"
 	"errors"
+	"net/http"
 	"net/http/httptest"
 	"reflect"
 	"testing"
@@ -90,6 +91,7 @@ func TestTracingHooks(t *testing.T) {
 				"span.kind":        serverType,
 				"http.status_code": int64(500),
 				"error":            true,
+				"twirp.error_code": "internal",
 			},
 			expectedLogs: []mocktracer.MockLogRecord{
 				{
@@ -104,6 +106,100 @@ func TestTracingHooks(t *testing.T) {
 							ValueKind:   reflect.String,
 							ValueString: "test",
 						},
+						{
+							Key:         "meta.cause",
+							ValueKind:   reflect.String,
+							ValueString: "*errors.errorString",
+						},
+					},
+				},
+			},
+			errExpected: true,
+		},
+		{
+			desc:      "logs the wrapped cause of an error when correct option is set",
+			service:   twirptest.ErroringHatmaker(errors.New("test")),
+			traceOpts: []TraceOption{IncludeErrorCause(true)},
+			expectedTags: map[string]interface{}{
+				"package":          "twirptest",
+				"component":        "twirp",
+				"service":          "Haberdasher",
+				"span.kind":        serverType,
+				"http.status_code": int64(500),
+				"error":            true,
+				"twirp.error_code": "internal",
+			},
+			expectedLogs: []mocktracer.MockLogRecord{
+				{
+					Fields: []mocktracer.MockKeyValue{
+						{
+							Key:         "event",
+							ValueKind:   reflect.String,
+							ValueString: "error",
+						},
+						{
+							Key:         "message",
+							ValueKind:   reflect.String,
+							ValueString: "test",
+						},
+						{
+							Key:         "meta.cause",
+							ValueKind:   reflect.String,
+							ValueString: "*errors.errorString",
+						},
+						{
+							Key:         "error.kind",
+							ValueKind:   reflect.String,
+							ValueString: "*errors.errorString",
+						},
+						{
+							Key:         "error.object",
+							ValueKind:   reflect.Ptr,
+							ValueString: "test",
+						},
+					},
+				},
+			},
+			errExpected: true,
+		},
+		{
+			desc:    "logs error metadata and redacts sensitive keys",
+			service: twirptest.ErroringHatmaker(twirp.InvalidArgumentError("Inches", "is too big").WithMeta("user", "alice")),
+			traceOpts: []TraceOption{
+				WithRedactedMetaKeys("user"),
+			},
+			expectedTags: map[string]interface{}{
+				"package":          "twirptest",
+				"component":        "twirp",
+				"service":          "Haberdasher",
+				"span.kind":        serverType,
+				"http.status_code": int64(400),
+				"error":            true,
+				"twirp.error_code": "invalid_argument",
+			},
+			expectedLogs: []mocktracer.MockLogRecord{
+				{
+					Fields: []mocktracer.MockKeyValue{
+						{
+							Key:         "event",
+							ValueKind:   reflect.String,
+							ValueString: "error",
+						},
+						{
+							Key:         "message",
+							ValueKind:   reflect.String,
+							ValueString: "Inches is too big",
+						},
+						{
+							Key:         "meta.argument",
+							ValueKind:   reflect.String,
+							ValueString: "Inches",
+						},
+						{
+							Key:         "meta.user",
+							ValueKind:   reflect.String,
+							ValueString: "[REDACTED]",
+						},
 					},
 				},
 			},
@@ -119,6 +215,7 @@ func TestTracingHooks(t *testing.T) {
 				"service":          "Haberdasher",
 				"span.kind":        serverType,
 				"http.status_code": int64(404),
+				"twirp.error_code": "not_found",
 			},
 			expectedLogs: []mocktracer.MockLogRecord{
 				{
@@ -142,6 +239,7 @@ func TestTracingHooks(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.desc, func(t *testing.T) {
+			global := setupGlobalMockTracer(t)
 			tracer := setupMockTracer()
 			hooks := NewOpenTracingHooks(tracer, tt.traceOpts...)
 
@@ -161,19 +259,153 @@ func TestTracingHooks(t *testing.T) {
 			assert.Equal(t, tt.expectedLogs, actualLogs)
 
 			assert.Equal(t, "MakeHat", rawSpan.OperationName, "expected operation name to be MakeHat")
+			assert.Empty(t, global.FinishedSpans(), "expected no spans on the global tracer")
 		})
 	}
 }
 
+func TestOperationNameFunc(t *testing.T) {
+	tests := []struct {
+		desc          string
+		traceOpts     []TraceOption
+		operationName string
+	}{
+		{
+			desc:          "names spans after the method by default",
+			operationName: "MakeHat",
+		},
+		{
+			desc:          "names spans after the full method name",
+			traceOpts:     []TraceOption{WithOperationNameFunc(FullMethodName)},
+			operationName: "twirptest.Haberdasher/MakeHat",
+		},
+		{
+			desc: "names spans with a custom function",
+			traceOpts: []TraceOption{WithOperationNameFunc(func(packageName, serviceName, methodName string, req *http.Request) string {
+				return serviceName + "." + methodName
+			})},
+			operationName: "Haberdasher.MakeHat",
+		},
+		{
+			desc: "names deferred spans with the custom function",
+			traceOpts: []TraceOption{
+				WithOperationNameFunc(FullMethodName),
+				AllowMethods(MethodRule{Method: "MakeHat"}),
+			},
+			operationName: "twirptest.Haberdasher/MakeHat",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			tracer := setupMockTracer()
+			hooks := NewOpenTracingHooks(tracer, tt.traceOpts...)
+
+			server, client := serverAndClient(twirptest.NoopHatmaker(), hooks)
+			defer server.Close()
+
+			_, err := client.MakeHat(context.Background(), &twirptest.Size{})
+			if err != nil {
+				t.Fatalf("twirptest Client err=%q", err)
+			}
+
+			rawSpan := tracer.FinishedSpans()[0]
+			assert.Equal(t, tt.operationName, rawSpan.OperationName, "expected operation name to match")
+		})
+	}
+}
+
+func TestWithTraceContextFinishesSpansOnPanic(t *testing.T) {
+	tests := []struct {
+		desc      string
+		traceOpts []TraceOption
+		spans     int
+	}{
+		{
+			desc:  "finishes the server span",
+			spans: 1,
+		},
+		{
+			desc:      "finishes the lifecycle phase spans",
+			traceOpts: []TraceOption{WithLifecyclePhases(LifecycleSpans)},
+			spans:     4,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			tracer := setupMockTracer()
+			hooks := NewOpenTracingHooks(tracer, tt.traceOpts...)
+			handler := WithTraceContext(twirptest.NewHaberdasherServer(twirptest.PanickyHatmaker("out of fabric"), hooks), tracer)
+
+			req := httptest.NewRequest("POST", "/twirp/twirptest.Haberdasher/MakeHat", nil)
+			req.Header.Set("Content-Type", "application/protobuf")
+			assert.PanicsWithValue(t, "out of fabric", func() {
+				handler.ServeHTTP(httptest.NewRecorder(), req)
+			}, "expected the panic to be propagated")
+
+			spans := tracer.FinishedSpans()
+			if !assert.Len(t, spans, tt.spans, "expected every span to be finished") {
+				return
+			}
+			serverSpan := spans[len(spans)-1]
+			assert.Equal(t, "MakeHat", serverSpan.OperationName)
+			assert.Equal(t, true, serverSpan.Tag("error"), "expected the span to be marked as erroneous")
+
+			logs := serverSpan.Logs()
+			if assert.NotEmpty(t, logs, "expected the panic to be logged") {
+				fields := map[string]string{}
+				for _, field := range logs[len(logs)-1].Fields {
+					fields[field.Key] = field.ValueString
+				}
+				assert.Equal(t, "panic", fields["event"])
+				assert.Equal(t, "out of fabric", fields["message"])
+				assert.Contains(t, fields["stack"], "twirptest.PanickyHatmaker", "expected the stack to include the panicking handler")
+			}
+		})
+	}
+}
+
+func TestWithTraceContextEndsSpansWhenResponseSent(t *testing.T) {
+	tracer := setupMockTracer()
+	hooks := NewOpenTracingHooks(tracer)
+	var responded time.Time
+	server := twirptest.NewHaberdasherServer(twirptest.NoopHatmaker(), hooks)
+	handler := WithTraceContext(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.ServeHTTP(w, r)
+		responded = time.Now()
+		time.Sleep(20 * time.Millisecond)
+	}), tracer, IncludePayloadSizes(true))
+
+	req := httptest.NewRequest("POST", "/twirp/twirptest.Haberdasher/MakeHat", nil)
+	req.Header.Set("Content-Type", "application/protobuf")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := tracer.FinishedSpans()
+	if assert.Len(t, spans, 1) {
+		assert.False(t, spans[0].FinishTime.After(responded), "expected the span to end when the response is sent")
+		assert.Contains(t, spans[0].Tags(), "rpc.response.size", "expected the wrapper to tag the payload sizes")
+	}
+}
+
 func serverAndClient(h twirptest.Haberdasher, hooks *twirp.ServerHooks) (*httptest.Server, twirptest.Haberdasher) {
 	return twirptest.ServerAndClient(h, hooks)
 }
 
 func setupMockTracer() *mocktracer.MockTracer {
-	tracer := mocktracer.New()
-	opentracing.SetGlobalTracer(tracer)
+	return mocktracer.New()
+}
+
+// setupGlobalMockTracer installs a separate mock tracer as the global tracer
+// so tests can assert that no spans leak to it.
+func setupGlobalMockTracer(t *testing.T) *mocktracer.MockTracer {
+	global := mocktracer.New()
+	opentracing.SetGlobalTracer(global)
+	t.Cleanup(func() {
+		opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+	})
 
-	return tracer
+	return global
 }
 
 func zeroOutTimestamps(recs []mocktracer.MockLogRecord) {